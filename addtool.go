@@ -3,26 +3,46 @@ package main
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/astaxie/beego/logs"
+	"github.com/linimbus/tcpproxy-windows/keystore"
 	"github.com/lxn/walk"
 	. "github.com/lxn/walk/declarative"
 )
 
 type BackendConfig struct {
-	Address  string `json:"Address"`
-	Port     int    `json:"Port"`
-	Protocol string `json:"Protocol"`
-	Tls      string `json:"Tls"`
-	Timeout  int    `json:"Timeout"`
+	Address       string `json:"Address"`
+	Port          int    `json:"Port"`
+	Protocol      string `json:"Protocol"`
+	Tls           string `json:"Tls"`
+	Timeout       int    `json:"Timeout"`
+	SourceAddress string `json:"SourceAddress,omitempty"`
+	BindInterface string `json:"BindInterface,omitempty"`
+	CAFile        string `json:"CAFile,omitempty"`
+
+	keystore.Source
+	PasswordProtected string `json:"PasswordProtected,omitempty"`
+	PasswordLegacy    string `json:"Password,omitempty"`
+
+	Pins            []string `json:"Pins,omitempty"`
+	TrustOnFirstUse bool     `json:"TrustOnFirstUse,omitempty"`
 }
 
 type LinkConfig struct {
-	Address  string        `json:"Address"`
-	Port     int           `json:"Port"`
-	Protocol string        `json:"Protocol"`
-	Tls      string        `json:"Tls"`
-	Backend  BackendConfig `json:"Backend"`
+	Address   string        `json:"Address"`
+	Port      int           `json:"Port"`
+	Protocol  string        `json:"Protocol"`
+	Tls       string        `json:"Tls"`
+	Hostnames string        `json:"Hostnames,omitempty"`
+	CAFile    string        `json:"CAFile,omitempty"`
+	Backend   BackendConfig `json:"Backend"`
+
+	keystore.Source
+	PasswordProtected string `json:"PasswordProtected,omitempty"`
+	PasswordLegacy    string `json:"Password,omitempty"`
+
+	Maintenance *MaintenanceConfig `json:"Maintenance,omitempty"`
 }
 
 func IfaceOptions() []string {
@@ -48,6 +68,23 @@ func IfaceOptions() []string {
 	return output
 }
 
+func IfaceNameOptions() []string {
+	output := []string{""}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logs.Error(err.Error())
+		return output
+	}
+	for _, v := range ifaces {
+		if v.Flags&net.FlagUp == 0 {
+			continue
+		}
+		output = append(output, v.Name)
+	}
+	return output
+}
+
 type BackendItem struct {
 	Index   int
 	Address string
@@ -63,12 +100,27 @@ func AddToolBar() {
 	var consolePort *walk.NumberEdit
 	var consoleTls *walk.ComboBox
 	var consoleProtocol *walk.ComboBox
+	var consoleHostnames *walk.LineEdit
+	var consoleCert *walk.LineEdit
+	var consoleKey *walk.LineEdit
+	var consoleCA *walk.LineEdit
+	var consolePkcs12 *walk.LineEdit
+	var consolePassword *walk.LineEdit
 
 	var backendAddr *walk.LineEdit
 	var backendPort *walk.NumberEdit
 	var backendTls *walk.ComboBox
 	var backendProtocol *walk.ComboBox
 	var backendTimeout *walk.NumberEdit
+	var backendSource *walk.LineEdit
+	var backendIface *walk.ComboBox
+	var backendCA *walk.LineEdit
+	var backendCert *walk.LineEdit
+	var backendKey *walk.LineEdit
+	var backendPkcs12 *walk.LineEdit
+	var backendPassword *walk.LineEdit
+	var backendPins *walk.LineEdit
+	var backendTofu *walk.CheckBox
 
 	var addLink LinkConfig
 	var backend BackendConfig
@@ -131,6 +183,79 @@ func AddToolBar() {
 							addLink.Tls = consoleTls.Text()
 						},
 					},
+					Label{
+						Text: "Listen Hostnames:",
+					},
+					LineEdit{
+						AssignTo:    &consoleHostnames,
+						CueBanner:   "optional, proxy.example.com",
+						ToolTipText: "extra hostnames in the listen certificate, separated by commas",
+						Text:        "",
+						OnTextChanged: func() {
+							addLink.Hostnames = consoleHostnames.Text()
+						},
+					},
+					Label{
+						Text: "Listen Cert:",
+					},
+					LineEdit{
+						AssignTo:    &consoleCert,
+						CueBanner:   "optional, C:\\certs\\server.crt",
+						ToolTipText: "pem certificate file, generated by local ca when empty",
+						Text:        "",
+						OnTextChanged: func() {
+							addLink.Cert = consoleCert.Text()
+						},
+					},
+					Label{
+						Text: "Listen Key:",
+					},
+					LineEdit{
+						AssignTo:    &consoleKey,
+						CueBanner:   "optional, C:\\certs\\server.key",
+						ToolTipText: "pem private key file of listen cert",
+						Text:        "",
+						OnTextChanged: func() {
+							addLink.Key = consoleKey.Text()
+						},
+					},
+					Label{
+						Text: "Listen Pkcs12:",
+					},
+					LineEdit{
+						AssignTo:    &consolePkcs12,
+						CueBanner:   "optional, C:\\certs\\server.pfx",
+						ToolTipText: "pfx bundle used instead of listen cert and key",
+						Text:        "",
+						OnTextChanged: func() {
+							addLink.Pkcs12 = consolePkcs12.Text()
+						},
+					},
+					Label{
+						Text: "Listen Password:",
+					},
+					LineEdit{
+						AssignTo:     &consolePassword,
+						CueBanner:    "optional",
+						ToolTipText:  "password of listen pfx or encrypted key",
+						PasswordMode: true,
+						Text:         "",
+						OnTextChanged: func() {
+							addLink.Password = consolePassword.Text()
+						},
+					},
+					Label{
+						Text: "Listen Client CA:",
+					},
+					LineEdit{
+						AssignTo:    &consoleCA,
+						CueBanner:   "optional, C:\\certs\\client-ca.crt",
+						ToolTipText: "pem ca bundle, clients must present a certificate signed by it",
+						Text:        "",
+						OnTextChanged: func() {
+							addLink.CAFile = consoleCA.Text()
+						},
+					},
 					Label{
 						Text: "Listen Protocol:",
 					},
@@ -203,6 +328,118 @@ func AddToolBar() {
 							backend.Timeout = int(backendTimeout.Value())
 						},
 					},
+					Label{
+						Text: "Backend Source:",
+					},
+					LineEdit{
+						AssignTo:    &backendSource,
+						CueBanner:   "optional, 192.168.1.10,192.168.1.11",
+						ToolTipText: "local source address, several addresses are used in turn",
+						Text:        "",
+						OnTextChanged: func() {
+							backend.SourceAddress = backendSource.Text()
+						},
+					},
+					Label{
+						Text: "Backend Interface:",
+					},
+					ComboBox{
+						AssignTo:     &backendIface,
+						CurrentIndex: 0,
+						Model:        IfaceNameOptions(),
+						OnCurrentIndexChanged: func() {
+							backend.BindInterface = backendIface.Text()
+						},
+					},
+					Label{
+						Text: "Backend CA:",
+					},
+					LineEdit{
+						AssignTo:    &backendCA,
+						CueBanner:   "optional, C:\\certs\\backend-ca.crt",
+						ToolTipText: "pem ca bundle to verify backend certificate, not verified when empty",
+						Text:        "",
+						OnTextChanged: func() {
+							backend.CAFile = backendCA.Text()
+						},
+					},
+					Label{
+						Text: "Backend Cert:",
+					},
+					LineEdit{
+						AssignTo:    &backendCert,
+						CueBanner:   "optional, C:\\certs\\client.crt",
+						ToolTipText: "pem client certificate presented to backend",
+						Text:        "",
+						OnTextChanged: func() {
+							backend.Cert = backendCert.Text()
+						},
+					},
+					Label{
+						Text: "Backend Key:",
+					},
+					LineEdit{
+						AssignTo:    &backendKey,
+						CueBanner:   "optional, C:\\certs\\client.key",
+						ToolTipText: "pem private key file of backend cert",
+						Text:        "",
+						OnTextChanged: func() {
+							backend.Key = backendKey.Text()
+						},
+					},
+					Label{
+						Text: "Backend Pkcs12:",
+					},
+					LineEdit{
+						AssignTo:    &backendPkcs12,
+						CueBanner:   "optional, C:\\certs\\client.pfx",
+						ToolTipText: "pfx bundle used instead of backend cert and key",
+						Text:        "",
+						OnTextChanged: func() {
+							backend.Pkcs12 = backendPkcs12.Text()
+						},
+					},
+					Label{
+						Text: "Backend Password:",
+					},
+					LineEdit{
+						AssignTo:     &backendPassword,
+						CueBanner:    "optional",
+						ToolTipText:  "password of backend pfx or encrypted key",
+						PasswordMode: true,
+						Text:         "",
+						OnTextChanged: func() {
+							backend.Password = backendPassword.Text()
+						},
+					},
+					Label{
+						Text: "Backend Pins:",
+					},
+					LineEdit{
+						AssignTo:    &backendPins,
+						CueBanner:   "optional, sha256/base64 or certificate fingerprint",
+						ToolTipText: "backend certificate pins separated by commas, any match is accepted",
+						Text:        "",
+						OnTextChanged: func() {
+							backend.Pins = nil
+							for _, v := range strings.Split(backendPins.Text(), ",") {
+								if v = strings.TrimSpace(v); v != "" {
+									backend.Pins = append(backend.Pins, v)
+								}
+							}
+						},
+					},
+					Label{
+						Text: "Backend TOFU:",
+					},
+					CheckBox{
+						AssignTo:    &backendTofu,
+						Text:        "trust on first use",
+						ToolTipText: "record the backend key on the first connection and refuse later changes",
+						OnCheckedChanged: func() {
+							backend.TrustOnFirstUse = backendTofu.Checked()
+						},
+					},
 				},
 			},
 			Composite{
@@ -233,8 +470,14 @@ func AddToolBar() {
 									return
 								}
 
+								_, err := NewLinkDialer(backend)
+								if err != nil {
+									ErrorBoxAction(dlg, err.Error())
+									return
+								}
+
 								addLink.Backend = backend
-								err := LinkAdd(addLink)
+								err = LinkAdd(addLink)
 								if err != nil {
 									ErrorBoxAction(dlg, err.Error())
 									return
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	CA_VALIDITY       = 10 * 365 * 24 * time.Hour
+	LEAF_VALIDITY     = 365 * 24 * time.Hour
+	LEAF_RENEW_BEFORE = 30 * 24 * time.Hour
+)
+
+// 每个安装实例独立的本地CA，链路证书都由它签发，客户端只需要信任一次CA证书
+type LocalCA struct {
+	sync.Mutex
+
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	leafs   map[string]*tls.Certificate
+}
+
+var localCA *LocalCA
+var localCALock sync.Mutex
+
+func caDir() string {
+	return fmt.Sprintf("%s\\ca", appDataDir())
+}
+
+func LocalCAGet() (*LocalCA, error) {
+	localCALock.Lock()
+	defer localCALock.Unlock()
+
+	if localCA != nil {
+		return localCA, nil
+	}
+
+	dir := caDir()
+	_, err := os.Stat(dir)
+	if err != nil {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file := fmt.Sprintf("%s\\ca.pem", dir)
+	ca, err := localCALoad(file)
+	if os.IsNotExist(err) {
+		ca, err = localCACreate(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logs.Info("local ca %s loaded, expire %s", ca.cert.Subject.CommonName, ca.cert.NotAfter.Format(time.DateOnly))
+	ca.prune()
+	certExpiry.Track("local ca", []*x509.Certificate{ca.cert})
+	localCA = ca
+	return ca, nil
+}
+
+func serialNumber() *big.Int {
+	max := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, _ := rand.Int(rand.Reader, max)
+	return serial
+}
+
+func pemEncode(der []byte, key crypto.Signer) ([]byte, error) {
+	output := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if key == nil {
+		return output, nil
+	}
+	keyder, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(output, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyder})...), nil
+}
+
+// 解析PEM中的证书链和私钥，并填充Leaf
+func tlsKeyPair(body []byte) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(body, body)
+	if err != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+func localCALoad(file string) (*LocalCA, error) {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tlsKeyPair(body)
+	if err != nil {
+		return nil, fmt.Errorf("local ca %s invalid, %s", file, err.Error())
+	}
+	cert := pair.Leaf
+	if !cert.IsCA {
+		return nil, fmt.Errorf("local ca %s is not a ca certificate", file)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("local ca %s expired at %s", file, cert.NotAfter.Format(time.DateOnly))
+	}
+
+	return &LocalCA{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		key:     pair.PrivateKey.(crypto.Signer),
+		leafs:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+func localCACreate(file string) (*LocalCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Organization:       []string{"TcpProxy App co."},
+			OrganizationalUnit: []string{"TcpProxy App"},
+			CommonName:         fmt.Sprintf("TcpProxy Local CA %s", hostname),
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := pemEncode(der, key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(file, body, 0600)
+	if err != nil {
+		return nil, err
+	}
+	logs.Info("local ca created %s", file)
+
+	return localCALoad(file)
+}
+
+// 链路证书的SAN：监听任意地址时包含本机所有地址和localhost，另加配置的主机名
+func tlsHostnames(addr string, hostnames string) []string {
+	var output []string
+	if addr == "0.0.0.0" || addr == "::" || addr == "" {
+		output = append(output, "localhost", "127.0.0.1", "::1")
+		output = append(output, IfaceOptions()[2:]...)
+	} else {
+		output = append(output, addr)
+	}
+	for _, v := range strings.Split(hostnames, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			output = append(output, v)
+		}
+	}
+	return output
+}
+
+func leafName(sans []string, client bool) string {
+	list := append([]string{}, sans...)
+	sort.Strings(list)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v %s", client, strings.Join(list, ","))))
+	return hex.EncodeToString(sum[:8])
+}
+
+// 证书仍由当前CA签发且不在续期窗口内时可以继续使用
+func (ca *LocalCA) leafValid(cert *tls.Certificate) bool {
+	if cert == nil || cert.Leaf == nil {
+		return false
+	}
+	if time.Now().Add(LEAF_RENEW_BEFORE).After(cert.Leaf.NotAfter) {
+		return false
+	}
+	return cert.Leaf.CheckSignatureFrom(ca.cert) == nil
+}
+
+// 签发服务端或客户端证书，内存和磁盘各缓存一份，临近过期时重新签发并覆盖原文件。
+// 链路在每次握手时调用，长期运行的链路也会使用续期后的证书。
+func (ca *LocalCA) Issue(sans []string, client bool) (*tls.Certificate, error) {
+	ca.Lock()
+	defer ca.Unlock()
+
+	name := leafName(sans, client)
+	if cert := ca.leafs[name]; cert != nil && time.Now().Add(LEAF_RENEW_BEFORE).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	file := fmt.Sprintf("%s\\leaf-%s.pem", caDir(), name)
+	body, err := os.ReadFile(file)
+	if err == nil {
+		cert, err := tlsKeyPair(body)
+		if err == nil && ca.leafValid(&cert) {
+			ca.leafs[name] = &cert
+			return &cert, nil
+		}
+	}
+
+	cert, body, err := ca.issue(sans, client)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(file, body, 0600)
+	if err != nil {
+		logs.Warning("save leaf certificate %s failed, %s", file, err.Error())
+	}
+	logs.Info("local ca issued certificate for %v, expire %s", sans, cert.Leaf.NotAfter.Format(time.DateOnly))
+
+	ca.leafs[name] = &cert
+	ca.prune()
+	return &cert, nil
+}
+
+// 删除已过期或不是当前CA签发的证书文件，地址或主机名变化后旧文件不会一直保留
+func (ca *LocalCA) prune() {
+	files, err := filepath.Glob(fmt.Sprintf("%s\\leaf-*.pem", caDir()))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err == nil {
+			cert, err := tlsKeyPair(body)
+			if err == nil && now.Before(cert.Leaf.NotAfter) && cert.Leaf.CheckSignatureFrom(ca.cert) == nil {
+				continue
+			}
+		}
+		err = os.Remove(file)
+		if err != nil {
+			logs.Warning("remove leaf certificate %s failed, %s", file, err.Error())
+			continue
+		}
+		logs.Info("local ca removed stale certificate %s", file)
+	}
+}
+
+func (ca *LocalCA) issue(sans []string, client bool) (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Organization:       []string{"TcpProxy App co."},
+			OrganizationalUnit: []string{"TcpProxy App"},
+			CommonName:         "TcpProxy App",
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(LEAF_VALIDITY),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	if len(sans) > 0 {
+		template.Subject.CommonName = sans[0]
+	}
+	for _, v := range sans {
+		if ip := net.ParseIP(v); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, v)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	body, err := pemEncode(der, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	body = append(body, ca.certPEM...)
+
+	cert, err := tlsKeyPair(body)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return cert, body, nil
+}
+
+func (ca *LocalCA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// 导出CA证书，扩展名为.der或.cer时导出DER格式，否则导出PEM
+func (ca *LocalCA) Export(filename string) error {
+	body := ca.certPEM
+	lower := strings.ToLower(filename)
+	if strings.HasSuffix(lower, ".der") || strings.HasSuffix(lower, ".cer") {
+		body = ca.cert.Raw
+	}
+	return os.WriteFile(filename, body, 0644)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/linimbus/tcpproxy-windows/keystore"
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+const CERT_EXPIRY_INTERVAL = time.Hour
+
+type CertExpiryConfig struct {
+	WarnDays []int  `json:"WarnDays,omitempty"`
+	Webhook  string `json:"Webhook,omitempty"`
+}
+
+var certExpiryConfig CertExpiryConfig
+
+// 到期告警同时写日志和弹出托盘提示
+var certExpiry = keystore.NewExpiryMonitor(func(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	logs.Warning(msg)
+	NotifyWarning("Certificate Expiry", msg)
+})
+
+func certExpiryFile() string {
+	return fmt.Sprintf("%s\\certexpiry.json", appDataDir())
+}
+
+func CertExpiryInit() error {
+	value, err := os.ReadFile(certExpiryFile())
+	if err == nil {
+		err = json.Unmarshal(value, &certExpiryConfig)
+		if err != nil {
+			logs.Error(err.Error())
+		}
+	}
+	certExpiry.Configure(certExpiryConfig.WarnDays, certExpiryConfig.Webhook)
+	return nil
+}
+
+// 链路启动、证书加载完成后开始检查
+func CertExpiryStart() {
+	go func() {
+		for {
+			certExpiry.Check()
+			time.Sleep(CERT_EXPIRY_INTERVAL)
+		}
+	}()
+}
+
+func CertExpiryUpdate(cfg CertExpiryConfig) error {
+	value, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = SaveToFile(certExpiryFile(), value)
+	if err != nil {
+		return err
+	}
+	certExpiryConfig = cfg
+	certExpiry.Configure(cfg.WarnDays, cfg.Webhook)
+	certExpiry.Check()
+	return nil
+}
+
+func linkExpiryName(bind string, side string) string {
+	return fmt.Sprintf("link %s %s", bind, side)
+}
+
+func LinkExpiryUntrack(bind string) {
+	certExpiry.Untrack(linkExpiryName(bind, "listen"))
+	certExpiry.Untrack(linkExpiryName(bind, "backend"))
+}
+
+// 链路监听和后端的证书，最早到期的在前
+func LinkExpiry(bind string) []keystore.CertExpiry {
+	var output []keystore.CertExpiry
+	prefix := fmt.Sprintf("link %s ", bind)
+	for _, v := range certExpiry.List() {
+		if strings.HasPrefix(v.Name, prefix) {
+			output = append(output, v)
+		}
+	}
+	return output
+}
+
+// 链路证书的剩余天数，显示在链路列表中
+func LinkExpiryDays(bind string) string {
+	list := LinkExpiry(bind)
+	if len(list) == 0 {
+		return ""
+	}
+	days := list[0].Days()
+	if days < 0 {
+		return "expired"
+	}
+	return fmt.Sprintf("%d days", days)
+}
+
+func warnDaysString(days []int) string {
+	var output []string
+	for _, v := range days {
+		output = append(output, strconv.Itoa(v))
+	}
+	return strings.Join(output, ",")
+}
+
+func warnDaysParse(value string) ([]int, error) {
+	var output []int
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		day, err := strconv.Atoi(v)
+		if err != nil || day < 0 {
+			return nil, fmt.Errorf("invalid warning day %s", v)
+		}
+		output = append(output, day)
+	}
+	return output, nil
+}
+
+// 查看所有证书的到期时间，配置告警天数和Webhook
+func CertExpiryAction(form walk.Form) {
+	var dlg *walk.Dialog
+	var acceptPB, cancelPB *walk.PushButton
+	var warnDays, webhook *walk.LineEdit
+
+	var lines []string
+	for _, v := range certExpiry.List() {
+		lines = append(lines, v.String())
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "no certificate loaded")
+	}
+
+	days := certExpiryConfig.WarnDays
+	if len(days) == 0 {
+		days = keystore.DefaultWarnDays
+	}
+
+	_, err := Dialog{
+		AssignTo:      &dlg,
+		Title:         "Certificate Expiry",
+		Icon:          walk.IconInformation(),
+		DefaultButton: &acceptPB,
+		CancelButton:  &cancelPB,
+		Size:          Size{400, 250},
+		MinSize:       Size{400, 250},
+		Layout:        VBox{Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10}},
+		Children: []Widget{
+			TextLabel{
+				Text: strings.Join(lines, "\n"),
+			},
+			Composite{
+				Layout: Grid{Columns: 2},
+				Children: []Widget{
+					Label{
+						Text: "Warning Days:",
+					},
+					LineEdit{
+						AssignTo: &warnDays,
+						Text:     warnDaysString(days),
+					},
+					Label{
+						Text: "Webhook:",
+					},
+					LineEdit{
+						AssignTo: &webhook,
+						Text:     certExpiryConfig.Webhook,
+					},
+				},
+			},
+			Composite{
+				Layout: HBox{},
+				Children: []Widget{
+					PushButton{
+						AssignTo: &acceptPB,
+						Text:     "Save",
+						OnClicked: func() {
+							days, err := warnDaysParse(warnDays.Text())
+							if err != nil {
+								ErrorBoxAction(dlg, err.Error())
+								return
+							}
+							err = CertExpiryUpdate(CertExpiryConfig{
+								WarnDays: days, Webhook: strings.TrimSpace(webhook.Text())})
+							if err != nil {
+								ErrorBoxAction(dlg, err.Error())
+								return
+							}
+							dlg.Accept()
+						},
+					},
+					PushButton{
+						AssignTo: &cancelPB,
+						Text:     "Cancel",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Run(form)
+	if err != nil {
+		logs.Error(err.Error())
+	}
+}
@@ -16,6 +16,7 @@ type LinkItem struct {
 	Speed   int64
 	Traffic int64
 	Status  string
+	Cert    string
 
 	checked bool
 }
@@ -50,6 +51,8 @@ func (n *LinkModel) Value(row, col int) interface{} {
 		return ByteView(item.Traffic)
 	case 5:
 		return item.Status
+	case 6:
+		return item.Cert
 	}
 	panic("unexpected col")
 }
@@ -86,6 +89,8 @@ func (m *LinkModel) Sort(col int, order walk.SortOrder) error {
 			return c(a.Traffic < b.Traffic)
 		case 5:
 			return c(a.Status < b.Status)
+		case 6:
+			return c(a.Cert < b.Cert)
 		}
 		panic("unreachable")
 	})
@@ -93,13 +98,14 @@ func (m *LinkModel) Sort(col int, order walk.SortOrder) error {
 }
 
 const (
-	STATUS_UNLINK = "unlink"
-	STATUS_LINK   = "link"
+	STATUS_UNLINK      = "unlink"
+	STATUS_LINK        = "link"
+	STATUS_MAINTENANCE = "maintenance"
 )
 
 func StatusToIcon(status string) walk.Image {
 	switch status {
-	case STATUS_LINK:
+	case STATUS_LINK, STATUS_MAINTENANCE:
 		return ICON_STATUS_LINK
 	case STATUS_UNLINK:
 		return ICON_STATUS_UNLINK
@@ -239,6 +245,7 @@ func TableWight() []Widget {
 				{Title: "Speed", Width: 60},
 				{Title: "Traffic", Width: 60},
 				{Title: "Status", Width: 80},
+				{Title: "Cert", Width: 70},
 			},
 			StyleCell: func(style *walk.CellStyle) {
 				item := consoleLinkTable.items[style.Row()]
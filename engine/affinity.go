@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	AFFINITY_SOURCE_IP     = "source_ip"
+	AFFINITY_SOURCE_PREFIX = "source_prefix"
+	AFFINITY_SNI           = "sni"
+	AFFINITY_CLIENT_CERT   = "client_cert"
+)
+
+type affinityEntry struct {
+	key      string
+	endpoint *Endpoint
+	expire   time.Time
+}
+
+// 客户端到后端的粘性映射表，按LRU淘汰并限制条目数量。
+type Affinity struct {
+	sync.Mutex
+
+	Name    string
+	Mode    string
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List
+	hit     uint64
+	miss    uint64
+}
+
+var affinityLock sync.Mutex
+var affinityList []*Affinity
+
+func NewAffinity(name string, cfg *AffinityConfig) *Affinity {
+	switch cfg.Key {
+	case AFFINITY_SOURCE_IP, AFFINITY_SOURCE_PREFIX, AFFINITY_SNI, AFFINITY_CLIENT_CERT:
+	default:
+		log.Fatalf("cluster %s unknown affinity key %s.", name, cfg.Key)
+	}
+
+	a := &Affinity{Name: name, Mode: cfg.Key, ttl: 300 * time.Second, max: 10000,
+		entries: make(map[string]*list.Element), lru: list.New()}
+	if cfg.Ttl > 0 {
+		a.ttl = time.Duration(cfg.Ttl) * time.Second
+	}
+	if cfg.MaxEntries > 0 {
+		a.max = cfg.MaxEntries
+	}
+
+	affinityLock.Lock()
+	affinityList = append(affinityList, a)
+	affinityLock.Unlock()
+
+	return a
+}
+
+// SNI和客户端证书需要先完成TLS握手才能取得键值。
+func (a *Affinity) Handshake() bool {
+	return a.Mode == AFFINITY_SNI || a.Mode == AFFINITY_CLIENT_CERT
+}
+
+// 按配置的方式计算连接的粘性键值，SNI和客户端证书需要在握手之后调用。
+func (a *Affinity) Key(conn net.Conn) string {
+	switch a.Mode {
+	case AFFINITY_SOURCE_IP, AFFINITY_SOURCE_PREFIX:
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return ""
+		}
+		if a.Mode == AFFINITY_SOURCE_IP {
+			return addr.IP.String()
+		}
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return addr.IP.Mask(net.CIDRMask(64, 128)).String()
+	}
+
+	tlsconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsconn.ConnectionState()
+	if a.Mode == AFFINITY_SNI {
+		return state.ServerName
+	}
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *Affinity) Get(key string) *Endpoint {
+	if key == "" {
+		return nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	elem, ok := a.entries[key]
+	if ok {
+		entry := elem.Value.(*affinityEntry)
+		if time.Now().Before(entry.expire) {
+			a.hit++
+			return entry.endpoint
+		}
+		a.lru.Remove(elem)
+		delete(a.entries, key)
+	}
+	a.miss++
+	return nil
+}
+
+func (a *Affinity) Set(key string, endpoint *Endpoint) {
+	if key == "" {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	expire := time.Now().Add(a.ttl)
+	if elem, ok := a.entries[key]; ok {
+		entry := elem.Value.(*affinityEntry)
+		entry.endpoint = endpoint
+		entry.expire = expire
+		a.lru.MoveToFront(elem)
+		return
+	}
+
+	for a.lru.Len() >= a.max {
+		oldest := a.lru.Back()
+		a.lru.Remove(oldest)
+		delete(a.entries, oldest.Value.(*affinityEntry).key)
+	}
+
+	a.entries[key] = a.lru.PushFront(&affinityEntry{key: key, endpoint: endpoint, expire: expire})
+}
+
+func (a *Affinity) Stat() (int, uint64, uint64) {
+	a.Lock()
+	defer a.Unlock()
+	return a.lru.Len(), a.hit, a.miss
+}
+
+func affinityDisplay() {
+	affinityLock.Lock()
+	defer affinityLock.Unlock()
+
+	for _, a := range affinityList {
+		size, hit, miss := a.Stat()
+		log.Printf("affinity %s(%s) size %d hit %d miss %d\n", a.Name, a.Mode, size, hit, miss)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 后端被动探测失败后的屏蔽时长
+const endpointRetry = 10 * time.Second
+
+// 层级编号上限，避免配置或外部文件中的异常值分配大量空层级
+const endpointMaxTier = 16
+
+type Endpoint struct {
+	Address        string
+	Priority       int
+	Weight         int
+	Source         string
+	ServerName     string
+	MaxConnections int
+	Labels         map[string]string
+	Tls            *tls.Config
+
+	sessions int64
+	removed  bool
+	current  int
+
+	// 不可用截止时间，恢复后即为开始可用的时间
+	downUntil time.Time
+}
+
+func (e *Endpoint) Healthy(now time.Time) bool {
+	return !now.Before(e.downUntil)
+}
+
+// 未指定server_name时使用后端地址中的主机名，开启证书校验时必须有ServerName
+func (e *Endpoint) serverName() string {
+	if e.ServerName != "" {
+		return e.ServerName
+	}
+	host, _, err := net.SplitHostPort(e.Address)
+	if err != nil {
+		return e.Address
+	}
+	return host
+}
+
+// 后端自身的TLS配置优先于集群配置，ServerName与后端不一致时复制一份再修改，
+// 同一集群中不同主机的后端各自按自己的主机名校验证书。
+func (e *Endpoint) TlsConfig(def *tls.Config) *tls.Config {
+	cfg := def
+	if e.Tls != nil {
+		cfg = e.Tls
+	}
+	if cfg != nil && cfg.ServerName != e.serverName() {
+		cfg = cfg.Clone()
+		cfg.ServerName = e.serverName()
+	}
+	return cfg
+}
+
+func (e *Endpoint) full() bool {
+	return e.MaxConnections > 0 && atomic.LoadInt64(&e.sessions) >= int64(e.MaxConnections)
+}
+
+func NewEndpoint(cluster *ClusterConfig, cfg EndpointConfig, address string, tier int) *Endpoint {
+	e := &Endpoint{Address: address, Priority: tier, Weight: cfg.Weight, Source: cfg.Address,
+		ServerName: cfg.ServerName, MaxConnections: cfg.MaxConnections, Labels: cfg.Labels}
+
+	if e.Weight <= 0 {
+		e.Weight = 1
+	}
+
+	for name := range e.Labels {
+		if !metricsLabelCheck(name) {
+			log.Fatalf("cluster %s endpoint %s invalid label %s.", cluster.Name, cfg.Address, name)
+		}
+	}
+
+	if cfg.TlsName != "" {
+		tlscfg := TlsGet(cfg.TlsName)
+		if tlscfg == nil {
+			log.Fatalf("cluster %s endpoint %s not found %s tls.", cluster.Name, cfg.Address, cfg.TlsName)
+		}
+		e.Tls = TlsClientConfig(tlscfg, e.serverName())
+		if cluster.KeyLogFile != "" {
+			e.Tls.KeyLogWriter = TlsKeyLogWriter(cluster.KeyLogFile)
+		}
+	}
+	return e
+}
+
+type Balancer struct {
+	sync.Mutex
+
+	Name      string
+	tiers     [][]*Endpoint
+	threshold int
+	delay     time.Duration
+	active    int
+	pending   int
+	since     time.Time
+	failover  time.Time
+	affinity  *Affinity
+	dialer    *Dialer
+	times     int
+}
+
+var balancerLock sync.Mutex
+var balancers = make(map[string]*Balancer)
+
+// 同一集群被多个监听或镜像引用时共用健康状态和动态发现。
+func BalancerGet(cluster *ClusterConfig) *Balancer {
+	balancerLock.Lock()
+	defer balancerLock.Unlock()
+
+	b, ok := balancers[cluster.Name]
+	if !ok {
+		b = NewBalancer(cluster)
+		balancers[cluster.Name] = b
+	}
+	return b
+}
+
+func NewBalancer(cluster *ClusterConfig) *Balancer {
+	b := &Balancer{Name: cluster.Name, threshold: cluster.FailoverThreshold, pending: -1}
+
+	if b.threshold <= 0 || b.threshold > 100 {
+		b.threshold = 100
+	}
+	b.delay = time.Duration(cluster.FailbackDelay) * time.Second
+	b.dialer = NewDialer(cluster)
+
+	if cluster.Affinity != nil {
+		b.affinity = NewAffinity(cluster.Name, cluster.Affinity)
+	}
+
+	// 结构化后端可用priority指定层级，否则按所在列表决定
+	tiers := append([][]EndpointConfig{cluster.Endpoint}, cluster.Tiers...)
+	b.tiers = make([][]*Endpoint, len(tiers))
+	for i, list := range tiers {
+		for _, cfg := range list {
+			tier := i
+			if cfg.Priority > 0 {
+				tier = cfg.Priority
+			}
+			if tier > endpointMaxTier {
+				log.Fatalf("cluster %s endpoint %s tier %d exceeds %d.", cluster.Name, cfg.Address, tier, endpointMaxTier)
+			}
+			for len(b.tiers) <= tier {
+				b.tiers = append(b.tiers, nil)
+			}
+			if dnsSourceCheck(cfg.Address) {
+				NewDnsSource(b, cluster, tier, cfg)
+				continue
+			}
+			b.tiers[tier] = append(b.tiers[tier], NewEndpoint(cluster, cfg, cfg.Address, tier))
+		}
+	}
+
+	if cluster.EndpointFile != "" {
+		NewFileSource(b, cluster)
+	}
+
+	interval := cluster.HealthInterval
+	if interval == 0 && len(b.tiers) > 1 {
+		interval = 10
+	}
+	if interval > 0 {
+		go b.healthCheck(time.Duration(interval) * time.Second)
+	}
+
+	return b
+}
+
+func (b *Balancer) Endpoints() []*Endpoint {
+	b.Lock()
+	defer b.Unlock()
+	return b.endpoints()
+}
+
+func (b *Balancer) endpoints() []*Endpoint {
+	var output []*Endpoint
+	for _, tier := range b.tiers {
+		output = append(output, tier...)
+	}
+	return output
+}
+
+// 层级中故障节点比例未达到阈值时，该层级可以独立承载流量。
+func (b *Balancer) tierReady(tier []*Endpoint, now time.Time) bool {
+	var down int
+	for _, e := range tier {
+		if !e.Healthy(now) {
+			down++
+		}
+	}
+	return down*100 < b.threshold*len(tier)
+}
+
+func (b *Balancer) selectTier(now time.Time) int {
+	want := len(b.tiers) - 1
+	for i, tier := range b.tiers {
+		if b.tierReady(tier, now) {
+			want = i
+			break
+		}
+	}
+
+	if want >= b.active {
+		if want > b.active {
+			b.failover = now
+			log.Printf("cluster %s failover from tier %d to tier %d", b.Name, b.active, want)
+		}
+		b.active = want
+		b.pending = -1
+		return b.active
+	}
+
+	// 回切需要高优先级层级持续可用一段时间，避免来回抖动。
+	if b.pending != want {
+		b.pending = want
+		b.since = now
+	}
+	if now.Sub(b.since) >= b.delay {
+		log.Printf("cluster %s failback from tier %d to tier %d", b.Name, b.active, want)
+		b.active = want
+		b.pending = -1
+	}
+	return b.active
+}
+
+// 计算连接的粘性键值，未开启粘性时返回空串。
+func (b *Balancer) AffinityKey(conn net.Conn) string {
+	if b.affinity == nil {
+		return ""
+	}
+	return b.affinity.Key(conn)
+}
+
+// 记录粘性键值最近一次成功连接的后端。
+func (b *Balancer) Bind(key string, e *Endpoint) {
+	if b.affinity != nil {
+		b.affinity.Set(key, e)
+	}
+}
+
+// 返回本次连接依次尝试的后端列表，粘性映射的后端可用时排在首位。
+func (b *Balancer) Next(key string) []*Endpoint {
+	var sticky *Endpoint
+	if b.affinity != nil {
+		sticky = b.affinity.Get(key)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.tiers) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	active := b.selectTier(now)
+
+	// 故障转移期间，高优先级层级中转移之后才恢复的节点需等待回切。
+	var candidate []*Endpoint
+	for i := 0; i <= active; i++ {
+		for _, e := range b.tiers[i] {
+			if !e.Healthy(now) || e.full() {
+				continue
+			}
+			if i < active && e.downUntil.After(b.failover) {
+				continue
+			}
+			candidate = append(candidate, e)
+		}
+	}
+
+	// 全部不可用时仍然尝试所有未满的后端
+	if len(candidate) == 0 {
+		for _, e := range b.endpoints() {
+			if !e.full() {
+				candidate = append(candidate, e)
+			}
+		}
+	}
+	if len(candidate) == 0 {
+		return nil
+	}
+
+	// 平滑加权轮询选出首选后端，其余按轮转顺序作为重试备选
+	var best *Endpoint
+	total := 0
+	for _, e := range candidate {
+		e.current += e.Weight
+		total += e.Weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+
+	output := make([]*Endpoint, 0, len(candidate))
+	for _, e := range candidate {
+		if e == sticky {
+			output = append(output, e)
+		}
+	}
+	if best != sticky {
+		output = append(output, best)
+	}
+
+	b.times++
+	for i := range candidate {
+		e := candidate[(b.times+i)%len(candidate)]
+		if e != sticky && e != best {
+			output = append(output, e)
+		}
+	}
+	return output
+}
+
+// 原子替换某个动态来源提供的全部后端，地址和层级未变化的后端保留健康状态。
+// 被移除的后端不再分配新连接，已有会话继续运行直到结束。
+func (b *Balancer) Update(source string, list []*Endpoint) {
+	b.Lock()
+	defer b.Unlock()
+
+	exist := make(map[string]*Endpoint)
+	for i, tier := range b.tiers {
+		var output []*Endpoint
+		for _, e := range tier {
+			if e.Source == source {
+				exist[fmt.Sprintf("%d/%s", i, e.Address)] = e
+			} else {
+				output = append(output, e)
+			}
+		}
+		b.tiers[i] = output
+	}
+
+	for _, e := range list {
+		key := fmt.Sprintf("%d/%s", e.Priority, e.Address)
+		old, ok := exist[key]
+		if ok {
+			delete(exist, key)
+			old.Weight = e.Weight
+			e = old
+		} else {
+			e.Source = source
+			log.Printf("cluster %s add endpoint %s tier %d from %s", b.Name, e.Address, e.Priority, source)
+		}
+		for len(b.tiers) <= e.Priority {
+			b.tiers = append(b.tiers, nil)
+		}
+		b.tiers[e.Priority] = append(b.tiers[e.Priority], e)
+	}
+
+	// 去掉末尾的空层级，当前层级随之收回
+	for len(b.tiers) > 0 && len(b.tiers[len(b.tiers)-1]) == 0 {
+		b.tiers = b.tiers[:len(b.tiers)-1]
+	}
+	if b.active >= len(b.tiers) {
+		b.active = 0
+		b.pending = -1
+	}
+
+	for _, e := range exist {
+		e.removed = true
+		sessions := atomic.LoadInt64(&e.sessions)
+		if sessions > 0 {
+			log.Printf("cluster %s remove endpoint %s from %s, draining %d sessions",
+				b.Name, e.Address, source, sessions)
+		} else {
+			log.Printf("cluster %s remove endpoint %s from %s", b.Name, e.Address, source)
+		}
+	}
+}
+
+// 占用一个连接数，达到max_connections时返回false。在连接后端之前调用，
+// 连接失败时调用Release释放，并发连接也不会超过上限。
+func (b *Balancer) Acquire(e *Endpoint) bool {
+	for {
+		sessions := atomic.LoadInt64(&e.sessions)
+		if e.MaxConnections > 0 && sessions >= int64(e.MaxConnections) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&e.sessions, sessions, sessions+1) {
+			return true
+		}
+	}
+}
+
+func (b *Balancer) Release(e *Endpoint) {
+	sessions := atomic.AddInt64(&e.sessions, -1)
+	b.Lock()
+	removed := e.removed
+	b.Unlock()
+	if sessions == 0 && removed {
+		log.Printf("cluster %s endpoint %s drained", b.Name, e.Address)
+	}
+}
+
+func (b *Balancer) Dial(e *Endpoint, timeout time.Duration) (net.Conn, error) {
+	return b.dialer.Dial(e.Address, timeout)
+}
+
+func (b *Balancer) Down(e *Endpoint) {
+	b.Lock()
+	e.downUntil = time.Now().Add(endpointRetry)
+	b.Unlock()
+}
+
+func (b *Balancer) healthCheck(interval time.Duration) {
+	for {
+		for _, e := range b.Endpoints() {
+			conn, err := b.dialer.Dial(e.Address, 3*time.Second)
+			now := time.Now()
+			b.Lock()
+			if err != nil {
+				e.downUntil = now.Add(2 * interval)
+			} else if !e.Healthy(now) {
+				e.downUntil = now
+			}
+			b.Unlock()
+			if err == nil {
+				conn.Close()
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestEndpointTlsServerName(t *testing.T) {
+	// 集群的TLS配置默认使用第一个后端的主机名
+	def := &tls.Config{ServerName: "a.test"}
+	endpoints := []*Endpoint{
+		{Address: "a.test:443"},
+		{Address: "b.test:443"},
+		{Address: "192.0.2.1:443", ServerName: "c.test"},
+		{Address: "[2001:db8::1]:443"},
+	}
+	want := []string{"a.test", "b.test", "c.test", "2001:db8::1"}
+
+	for i, e := range endpoints {
+		cfg := e.TlsConfig(def)
+		if cfg.ServerName != want[i] {
+			t.Errorf("endpoint %s server name %q, want %q", e.Address, cfg.ServerName, want[i])
+		}
+	}
+	if endpoints[0].TlsConfig(def) != def {
+		t.Error("endpoint with the same server name copied the config")
+	}
+	if def.ServerName != "a.test" {
+		t.Errorf("cluster config modified to %q", def.ServerName)
+	}
+	if (&Endpoint{Address: "b.test:443"}).TlsConfig(nil) != nil {
+		t.Error("endpoint without tls returned a config")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"time"
+
+	"github.com/linimbus/tcpproxy-windows/keystore"
+)
+
+const certExpiryDefaultInterval = time.Hour
+
+var certExpiry = keystore.NewExpiryMonitor(func(format string, v ...any) {
+	log.Printf("WARNING: "+format+".", v...)
+})
+
+// 记录tls配置加载的证书链和CA的到期时间
+func tlsExpiryTrack(cfg *TlsConfig, cert tls.Certificate) {
+	certExpiry.TrackPair("tls "+cfg.Name, cert)
+	if cfg.CA == "" {
+		return
+	}
+	certs, err := keystore.LoadCerts(cfg.CA)
+	if err == nil {
+		certExpiry.Track("tls "+cfg.Name+" ca", certs)
+	}
+}
+
+// 所有监听和集群的证书加载完成后开始检查
+func CertExpiryStart() {
+	interval := certExpiryDefaultInterval
+	if cfg := globalconfig.CertExpiry; cfg != nil {
+		certExpiry.Configure(cfg.WarnDays, cfg.Webhook)
+		if cfg.Interval > 0 {
+			interval = time.Duration(cfg.Interval) * time.Second
+		}
+	}
+
+	certExpiry.Check()
+	go func() {
+		for {
+			time.Sleep(interval)
+			certExpiry.Check()
+		}
+	}()
+}
+
+func certExpiryDisplay() {
+	for _, v := range certExpiry.List() {
+		log.Printf("cert %s\n", v.String())
+	}
+}
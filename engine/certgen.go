@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/linimbus/tcpproxy-windows/keystore"
+)
+
+const (
+	CERT_CA     = "ca"
+	CERT_SERVER = "server"
+	CERT_CLIENT = "client"
+	CERT_CRL    = "crl"
+)
+
+type certgenOptions struct {
+	kind    string
+	name    string
+	hosts   string
+	keytype string
+	bits    int
+	days    int
+	dir     string
+	ca      string
+	force   bool
+	yaml    bool
+	ocsp    string
+	revoke  string
+}
+
+// engine certgen 子命令：生成mTLS用的CA、服务端证书和客户端证书
+func certgenMain(args []string) error {
+	var opt certgenOptions
+
+	fs := flag.NewFlagSet("certgen", flag.ExitOnError)
+	fs.StringVar(&opt.kind, "type", CERT_SERVER, "certificate type: ca, server, client or crl.")
+	fs.StringVar(&opt.name, "name", "", "common name, also the file name. default ca/server/client.")
+	fs.StringVar(&opt.hosts, "hosts", "", "server SANs separated by commas, hostnames or IPs.")
+	fs.StringVar(&opt.keytype, "key", "ecdsa", "key type: rsa, ecdsa or ed25519.")
+	fs.IntVar(&opt.bits, "bits", 2048, "rsa key size.")
+	fs.IntVar(&opt.days, "days", 0, "validity in days. default 3650 for ca, 7 for crl, 365 otherwise.")
+	fs.StringVar(&opt.dir, "dir", "certs", "output directory.")
+	fs.StringVar(&opt.ca, "ca", CERT_CA, "name of the ca in the output directory used for signing.")
+	fs.BoolVar(&opt.force, "force", false, "overwrite existing files.")
+	fs.BoolVar(&opt.yaml, "yaml", false, "print the matching tls stanza.")
+	fs.StringVar(&opt.ocsp, "ocsp", "", "ocsp responder url written into the certificate.")
+	fs.StringVar(&opt.revoke, "revoke", "", "crl: names of certificates in the output directory to revoke, separated by commas.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: engine certgen -type ca|server|client|crl [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	switch opt.kind {
+	case CERT_CA, CERT_SERVER, CERT_CLIENT:
+	case CERT_CRL:
+		return certgenCRL(&opt)
+	default:
+		return fmt.Errorf("unknown certificate type %s", opt.kind)
+	}
+	if opt.name == "" {
+		opt.name = opt.kind
+	}
+	if opt.days <= 0 {
+		opt.days = 365
+		if opt.kind == CERT_CA {
+			opt.days = 3650
+		}
+	}
+	if opt.kind == CERT_SERVER && opt.hosts == "" {
+		return errors.New("server certificate needs -hosts")
+	}
+
+	err := os.MkdirAll(opt.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	certfile := filepath.Join(opt.dir, opt.name+".crt")
+	keyfile := filepath.Join(opt.dir, opt.name+".key")
+	if !opt.force {
+		for _, v := range []string{certfile, keyfile} {
+			if _, err := os.Stat(v); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite", v)
+			}
+		}
+	}
+
+	key, err := certgenKey(opt.keytype, opt.bits)
+	if err != nil {
+		return err
+	}
+
+	template, err := certgenTemplate(&opt)
+	if err != nil {
+		return err
+	}
+
+	// CA自签名，其余证书由输出目录中的CA签发
+	parent, signer := template, key
+	cafile := filepath.Join(opt.dir, opt.ca+".crt")
+	if opt.kind != CERT_CA {
+		pair, err := tls.LoadX509KeyPair(cafile, filepath.Join(opt.dir, opt.ca+".key"))
+		if err != nil {
+			return fmt.Errorf("load ca %s failed, %s", opt.ca, err.Error())
+		}
+		parent, err = x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return err
+		}
+		if !parent.IsCA {
+			return fmt.Errorf("%s is not a ca certificate", cafile)
+		}
+		signer = pair.PrivateKey.(crypto.Signer)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return err
+	}
+	keyder, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = certgenWrite(keyfile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyder}), 0600)
+	if err != nil {
+		return err
+	}
+	err = certgenWrite(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s certificate %s written to %s and %s, expire %s\n",
+		opt.kind, opt.name, certfile, keyfile, template.NotAfter.Format(time.DateOnly))
+
+	if opt.yaml && opt.kind != CERT_CA {
+		fmt.Printf("tls:\n  - name: %s\n    cert: %s\n    key: %s\n    ca: %s\n",
+			opt.name, certgenAbs(certfile), certgenAbs(keyfile), certgenAbs(cafile))
+	}
+	return nil
+}
+
+// 由CA签发吊销列表 <ca>.crl，保留已有列表中的条目并追加 -revoke 指定的证书
+func certgenCRL(opt *certgenOptions) error {
+	if opt.days <= 0 {
+		opt.days = 7
+	}
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(opt.dir, opt.ca+".crt"), filepath.Join(opt.dir, opt.ca+".key"))
+	if err != nil {
+		return fmt.Errorf("load ca %s failed, %s", opt.ca, err.Error())
+	}
+	issuer, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	crlfile := filepath.Join(opt.dir, opt.ca+".crl")
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Duration(opt.days) * 24 * time.Hour),
+	}
+
+	body, err := os.ReadFile(crlfile)
+	if err == nil {
+		block, _ := pem.Decode(body)
+		if block == nil {
+			return fmt.Errorf("%s is not a pem crl", crlfile)
+		}
+		old, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return err
+		}
+		template.RevokedCertificateEntries = old.RevokedCertificateEntries
+		// 没有CRL编号扩展的旧文件从1开始编号
+		if old.Number != nil {
+			template.Number.Add(old.Number, big.NewInt(1))
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, name := range strings.Split(opt.revoke, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		certs, err := keystore.LoadCerts(filepath.Join(opt.dir, name+".crt"))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(certs[0].RawIssuer, issuer.RawSubject) {
+			return fmt.Errorf("%s is not issued by %s", name, opt.ca)
+		}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: certs[0].SerialNumber, RevocationTime: time.Now()})
+		fmt.Fprintf(os.Stderr, "revoke %s serial %s\n", name, certs[0].SerialNumber.Text(16))
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, issuer, pair.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return err
+	}
+	err = certgenWrite(crlfile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "crl %s written with %d entries, next update %s\n",
+		crlfile, len(template.RevokedCertificateEntries), template.NextUpdate.Format(time.DateOnly))
+	return nil
+}
+
+func certgenKey(keytype string, bits int) (crypto.Signer, error) {
+	switch keytype {
+	case "rsa":
+		if bits < 2048 {
+			return nil, fmt.Errorf("rsa key size %d is too small", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type %s", keytype)
+}
+
+func certgenTemplate(opt *certgenOptions) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: opt.name, Organization: []string{"tcpproxy"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Duration(opt.days) * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	switch opt.kind {
+	case CERT_CA:
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.MaxPathLenZero = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	case CERT_SERVER:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case CERT_CLIENT:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	if opt.ocsp != "" && opt.kind != CERT_CA {
+		template.OCSPServer = []string{opt.ocsp}
+	}
+	// RSA密钥交换需要KeyEncipherment
+	if opt.keytype == "rsa" && opt.kind != CERT_CA {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	for _, v := range strings.Split(opt.hosts, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, v)
+		}
+	}
+	return template, nil
+}
+
+// 先写临时文件再改名，避免中途失败留下不完整的密钥
+func certgenWrite(filename string, body []byte, perm os.FileMode) error {
+	tmp := filename + ".tmp"
+	err := os.WriteFile(tmp, body, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp, perm)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func certgenAbs(filename string) string {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return filename
+	}
+	return abs
+}
@@ -1,50 +1,173 @@
 package main
 
 import (
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"net"
+
+	"github.com/linimbus/tcpproxy-windows/keystore"
+	"github.com/linimbus/tcpproxy-windows/sockopt"
 )
 
+type MirrorConfig struct {
+	Cluster  string `yaml:"cluster"`
+	Percent  int    `yaml:"percent"`
+	MaxBytes int    `yaml:"max_bytes"`
+}
+
 type ListernerConfig struct {
-	Address string `yaml:"address"`
-	Cluster string `yaml:"cluster"`
-	Tlsname string `yaml:"tls"`
+	Address       string             `yaml:"address"`
+	Cluster       string             `yaml:"cluster"`
+	Tlsname       string             `yaml:"tls"`
+	KeyLogFile    string             `yaml:"key_log_file"`
+	Mirror        *MirrorConfig      `yaml:"mirror"`
+	SocketOptions *sockopt.Options   `yaml:"socket_options"`
+	Acceptors     int                `yaml:"acceptors"`
+	Mode          string             `yaml:"mode"`
+	Socks5        *Socks5Config      `yaml:"socks5"`
+	HttpConnect   *HttpConnectConfig `yaml:"http_connect"`
+	Sniff         *SniffConfig       `yaml:"sniff"`
+	Http          *HttpConfig        `yaml:"http"`
+	Policy        *PolicyConfig      `yaml:"policy"`
+	Maintenance   *MaintenanceConfig `yaml:"maintenance"`
+}
+
+type AffinityConfig struct {
+	Key        string `yaml:"key"`
+	Ttl        int    `yaml:"ttl"`
+	MaxEntries int    `yaml:"max_entries"`
+}
+
+// 既可以写成单个字符串，也可以写成字符串列表。
+type StringList []string
+
+func (s *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if unmarshal(&value) == nil {
+		*s = StringList{value}
+		return nil
+	}
+	return unmarshal((*[]string)(s))
+}
+
+// 后端既可以写成 "host:port" 字符串，也可以写成带权重等属性的结构。
+// labels 作为该后端监控指标的标签输出。
+type EndpointConfig struct {
+	Address        string            `yaml:"address"`
+	Weight         int               `yaml:"weight"`
+	Priority       int               `yaml:"priority"`
+	TlsName        string            `yaml:"tls"`
+	ServerName     string            `yaml:"server_name"`
+	MaxConnections int               `yaml:"max_connections"`
+	Labels         map[string]string `yaml:"labels"`
+}
+
+func (e *EndpointConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if unmarshal(&address) == nil {
+		*e = EndpointConfig{Address: address}
+		return nil
+	}
+
+	type plain EndpointConfig
+	return unmarshal((*plain)(e))
 }
 
 type ClusterConfig struct {
-	Name     string   `yaml:"name"`
-	Endpoint []string `yaml:"endpoints"`
-	TlsName  string   `yaml:"tls"`
+	Name              string             `yaml:"name"`
+	Endpoint          []EndpointConfig   `yaml:"endpoints"`
+	Tiers             [][]EndpointConfig `yaml:"tiers"`
+	FailoverThreshold int                `yaml:"failover_threshold"`
+	FailbackDelay     int                `yaml:"failback_delay"`
+	HealthInterval    int                `yaml:"health_interval"`
+	Affinity          *AffinityConfig    `yaml:"affinity"`
+	Resolver          string             `yaml:"resolver"`
+	ResolveInterval   int                `yaml:"resolve_interval"`
+	EndpointFile      string             `yaml:"endpoint_file"`
+	EndpointInterval  int                `yaml:"endpoint_file_interval"`
+	SourceAddress     StringList         `yaml:"source_address"`
+	BindInterface     string             `yaml:"bind_interface"`
+	SocketOptions     *sockopt.Options   `yaml:"socket_options"`
+	Proxy             StringList         `yaml:"proxy"`
+	ProxyTimeout      int                `yaml:"proxy_timeout"`
+	TlsName           string             `yaml:"tls"`
+	KeyLogFile        string             `yaml:"key_log_file"`
 }
 
+func (c *ClusterConfig) Empty() bool {
+	if c.EndpointFile != "" {
+		return false
+	}
+	for _, tier := range c.Tiers {
+		if len(tier) > 0 {
+			return false
+		}
+	}
+	return len(c.Endpoint) == 0
+}
+
+// 作为后端TLS默认的ServerName
+func (c *ClusterConfig) ServerName() string {
+	if len(c.Endpoint) == 0 {
+		return ""
+	}
+	if c.Endpoint[0].ServerName != "" {
+		return c.Endpoint[0].ServerName
+	}
+	host, _, err := net.SplitHostPort(c.Endpoint[0].Address)
+	if err != nil {
+		return c.Endpoint[0].Address
+	}
+	return host
+}
+
+// cert/key 可以是文件路径或内联PEM，也可以用 pkcs12 指定 .pfx 文件；
+// 密码来自 password、password_env 或 password_file。
+// pins 为对端证书的SHA-256指纹(sha256/<base64> 公钥或证书指纹)，满足其一即可。
+// crl 为吊销列表的文件、内联PEM或URL，须由 ca 签发，每 crl_refresh 秒重新加载。
+// ocsp_staple 开启后从证书中的OCSP地址或 ocsp_responder 获取响应并随握手下发。
 type TlsConfig struct {
-	Name string `yaml:"name"`
-	Cert string `yaml:"cert"`
-	Key  string `yaml:"key"`
-	CA   string `yaml:"ca"`
+	Name            string `yaml:"name"`
+	keystore.Source `yaml:",inline"`
+	CA              string     `yaml:"ca"`
+	Pins            StringList `yaml:"pins"`
+	CRL             StringList `yaml:"crl"`
+	CRLRefresh      int        `yaml:"crl_refresh"`
+	OcspStaple      bool       `yaml:"ocsp_staple"`
+	OcspResponder   string     `yaml:"ocsp_responder"`
+	OcspRefresh     int        `yaml:"ocsp_refresh"`
+}
+
+// 证书到期前 warn_days 天开始告警，默认30、14、7、1天，每 interval 秒检查一次；
+// 配置了 webhook 时以JSON POST告警。
+type CertExpiryConfig struct {
+	WarnDays []int  `yaml:"warn_days"`
+	Webhook  string `yaml:"webhook"`
+	Interval int    `yaml:"interval"`
 }
 
 type GlobalConfig struct {
-	Listeners []ListernerConfig `yaml:"listeners"`
-	TlsCfg    []TlsConfig       `yaml:"tls"`
-	Clusters  []ClusterConfig   `yaml:"clusters"`
+	Include    []string          `yaml:"include"`
+	Listeners  []ListernerConfig `yaml:"listeners"`
+	TlsCfg     []TlsConfig       `yaml:"tls"`
+	Clusters   []ClusterConfig   `yaml:"clusters"`
+	CertExpiry *CertExpiryConfig `yaml:"cert_expiry"`
+	Metrics    string            `yaml:"metrics"`
+	// 处于维护模式的监听地址列表，默认为配置文件目录下的 maintenance.state
+	MaintenanceFile string `yaml:"maintenance_file"`
 }
 
 var globalconfig *GlobalConfig
 
 func LoadConfig(filename string) error {
 
-	body, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-
 	config := new(GlobalConfig)
 	config.Listeners = make([]ListernerConfig, 0)
 	config.Clusters = make([]ClusterConfig, 0)
 	config.TlsCfg = make([]TlsConfig, 0)
 
-	err = yaml.Unmarshal(body, config)
+	loader := &configLoader{config: config,
+		loading: make(map[string]bool), origin: make(map[string]string)}
+
+	err := loader.load(filename)
 	if err != nil {
 		return err
 	}
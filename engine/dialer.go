@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/linimbus/tcpproxy-windows/sockopt"
+)
+
+// 集群连接后端时使用的源地址和网卡，业务连接、健康检查和流量镜像共用。
+type Dialer struct {
+	source    *sockopt.SourcePool
+	control   sockopt.Control
+	options   *sockopt.Options
+	keepalive time.Duration
+	hops      []*UpstreamHop
+}
+
+func NewDialer(cluster *ClusterConfig) *Dialer {
+	var err error
+
+	d := new(Dialer)
+	d.source, err = sockopt.NewSourcePool(cluster.SourceAddress)
+	if err != nil {
+		log.Fatalf("cluster %s %s.", cluster.Name, err.Error())
+	}
+
+	var device sockopt.Control
+	if cluster.BindInterface != "" {
+		device, err = sockopt.BindDevice(cluster.BindInterface)
+		if err != nil {
+			log.Fatalf("cluster %s %s.", cluster.Name, err.Error())
+		}
+	}
+
+	options, err := cluster.SocketOptions.Control()
+	if err != nil {
+		log.Fatalf("cluster %s %s.", cluster.Name, err.Error())
+	}
+	d.options = cluster.SocketOptions
+	d.control = sockopt.Chain(device, options)
+
+	// 配置了keepalive时关闭Go运行时默认的keepalive设置
+	if d.options.KeepAlive() {
+		d.keepalive = -1
+	}
+
+	for _, v := range cluster.Proxy {
+		hop, err := NewUpstreamHop(v, time.Duration(cluster.ProxyTimeout)*time.Second)
+		if err != nil {
+			log.Fatalf("cluster %s %s.", cluster.Name, err.Error())
+		}
+		d.hops = append(d.hops, hop)
+	}
+	return d
+}
+
+// 配置了上游代理时依次经过每一跳建立隧道，后端TLS在隧道建立之后再协商。
+func (d *Dialer) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	if len(d.hops) == 0 {
+		return d.dial(address, timeout)
+	}
+
+	conn, err := d.dial(d.hops[0].Address, d.hops[0].Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, hop := range d.hops {
+		target := address
+		if i+1 < len(d.hops) {
+			target = d.hops[i+1].Address
+		}
+		tunnel, err := hop.Connect(conn, target)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tunnel
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dial(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, Control: d.control, KeepAlive: d.keepalive}
+	if local := d.source.Next(address); local != nil {
+		dialer.LocalAddr = local
+	}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	err = d.options.Apply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DNS_SCHEME = "dns://"
+	SRV_SCHEME = "srv://"
+)
+
+// 按TTL刷新时的上下限，以及未配置间隔且无TTL时的默认刷新间隔
+const (
+	dnsMinInterval     = 5 * time.Second
+	dnsMaxInterval     = 300 * time.Second
+	dnsDefaultInterval = 30 * time.Second
+	dnsTimeout         = 3 * time.Second
+)
+
+// 后端地址写成 dns://host:port 或 srv://_service._tcp.domain 时由DNS动态发现。
+type DnsSource struct {
+	balancer *Balancer
+	template *Endpoint
+	tier     int
+	source   string
+	srv      bool
+	host     string
+	port     string
+	server   string
+	interval time.Duration
+}
+
+func dnsSourceCheck(addr string) bool {
+	return strings.HasPrefix(addr, DNS_SCHEME) || strings.HasPrefix(addr, SRV_SCHEME)
+}
+
+func NewDnsSource(b *Balancer, cluster *ClusterConfig, tier int, cfg EndpointConfig) *DnsSource {
+	addr := cfg.Address
+	d := &DnsSource{balancer: b, tier: tier, source: addr,
+		server: cluster.Resolver, interval: time.Duration(cluster.ResolveInterval) * time.Second}
+
+	if strings.HasPrefix(addr, SRV_SCHEME) {
+		d.srv = true
+		d.host = strings.TrimPrefix(addr, SRV_SCHEME)
+	} else {
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(addr, DNS_SCHEME))
+		if err != nil {
+			log.Fatalf("cluster %s endpoint %s invalid, %s", cluster.Name, addr, err.Error())
+		}
+		d.host = host
+		d.port = port
+
+		// 解析出的是IP地址，TLS校验仍使用域名
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+	}
+	d.template = NewEndpoint(cluster, cfg, addr, tier)
+
+	if d.server != "" {
+		if _, _, err := net.SplitHostPort(d.server); err != nil {
+			d.server = net.JoinHostPort(d.server, "53")
+		}
+	}
+
+	// 首次解析同步完成，保证启动后即有可用后端
+	wait := d.refresh()
+	go d.run(wait)
+
+	return d
+}
+
+func (d *DnsSource) run(wait time.Duration) {
+	for {
+		time.Sleep(wait)
+		wait = d.refresh()
+	}
+}
+
+// 解析失败或结果为空时保留上一次的后端列表。
+func (d *DnsSource) refresh() time.Duration {
+	addrs, ttl, err := d.resolve()
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no address")
+	}
+	if err != nil {
+		log.Printf("cluster %s resolve %s failed, keep last endpoints, %s",
+			d.balancer.Name, d.source, err.Error())
+		if d.interval > 0 && d.interval < dnsMinInterval {
+			return d.interval
+		}
+		return dnsMinInterval
+	}
+
+	var list []*Endpoint
+	for _, addr := range addrs {
+		e := *d.template
+		e.Address = addr
+		list = append(list, &e)
+	}
+	d.balancer.Update(d.source, list)
+
+	if d.interval > 0 {
+		return d.interval
+	}
+	if ttl == 0 {
+		return dnsDefaultInterval
+	}
+	wait := time.Duration(ttl) * time.Second
+	if wait < dnsMinInterval {
+		wait = dnsMinInterval
+	}
+	if wait > dnsMaxInterval {
+		wait = dnsMaxInterval
+	}
+	return wait
+}
+
+func (d *DnsSource) resolve() ([]string, uint32, error) {
+	if d.server == "" {
+		return d.resolveSystem()
+	}
+
+	if !d.srv {
+		ips, ttl, err := d.lookupHost(d.host, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		var addrs []string
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), d.port))
+		}
+		return addrs, ttl, nil
+	}
+
+	records, err := dnsQuery(d.server, d.host, DNS_TYPE_SRV, dnsTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []string
+	var ttl uint32
+	for _, srv := range records {
+		if srv.Type != DNS_TYPE_SRV {
+			continue
+		}
+		ttl = dnsMinTTL(ttl, srv.TTL)
+		ips, ipttl, err := d.lookupHost(srv.Target, records)
+		if err != nil {
+			log.Printf("cluster %s resolve %s failed, %s", d.balancer.Name, srv.Target, err.Error())
+			continue
+		}
+		ttl = dnsMinTTL(ttl, ipttl)
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// 先从SRV应答的附加区查找目标地址，找不到再分别查询A和AAAA记录。
+func (d *DnsSource) lookupHost(host string, additional []dnsRecord) ([]net.IP, uint32, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for _, r := range additional {
+		if r.IP != nil && strings.EqualFold(strings.TrimSuffix(r.Name, "."), strings.TrimSuffix(host, ".")) {
+			ips = append(ips, r.IP)
+			ttl = dnsMinTTL(ttl, r.TTL)
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	var lasterr error
+	for _, qtype := range []uint16{DNS_TYPE_A, DNS_TYPE_AAAA} {
+		records, err := dnsQuery(d.server, host, qtype, dnsTimeout)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		for _, r := range records {
+			if r.Type == qtype {
+				ips = append(ips, r.IP)
+				ttl = dnsMinTTL(ttl, r.TTL)
+			}
+		}
+	}
+	if len(ips) == 0 && lasterr != nil {
+		return nil, 0, lasterr
+	}
+	return ips, ttl, nil
+}
+
+// 未配置resolver时使用系统解析，遵循hosts文件和搜索域，没有TTL，按固定间隔刷新。
+func (d *DnsSource) resolveSystem() ([]string, uint32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	var addrs []string
+	if !d.srv {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, d.host)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.IP.String(), d.port))
+		}
+		return addrs, 0, nil
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, srv := range records {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, srv.Target)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.IP.String(), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return addrs, 0, nil
+}
+
+func dnsMinTTL(a uint32, b uint32) uint32 {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DNS_TYPE_A    = 1
+	DNS_TYPE_AAAA = 28
+	DNS_TYPE_SRV  = 33
+)
+
+type dnsRecord struct {
+	Name     string
+	Type     uint16
+	TTL      uint32
+	IP       net.IP
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func dnsPackName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid dns name %s", name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0), nil
+}
+
+func dnsUnpackName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 32; {
+		if off >= len(msg) {
+			return "", 0, errors.New("dns name overflow")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("dns name overflow")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("dns name overflow")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+	return "", 0, errors.New("dns name loop")
+}
+
+func dnsExchange(server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		cnt, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if cnt < 12 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(query) {
+			continue
+		}
+		// 应答被截断时改用TCP重新查询
+		if buf[2]&0x02 == 0 {
+			return buf[:cnt], nil
+		}
+		break
+	}
+
+	tcpconn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpconn.Close()
+	tcpconn.SetDeadline(time.Now().Add(timeout))
+
+	body := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(body, uint16(len(query)))
+	copy(body[2:], query)
+	_, err = tcpconn.Write(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var head [2]byte
+	_, err = io.ReadFull(tcpconn, head[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(head[:]))
+	_, err = io.ReadFull(tcpconn, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 向指定DNS服务器查询一种记录，返回应答区和附加区的全部记录。
+func dnsQuery(server string, name string, qtype uint16, timeout time.Duration) ([]dnsRecord, error) {
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:], uint16(rand.Intn(0x10000)))
+	binary.BigEndian.PutUint16(query[2:], 0x0100)
+	binary.BigEndian.PutUint16(query[4:], 1)
+
+	query, err := dnsPackName(query, name)
+	if err != nil {
+		return nil, err
+	}
+	query = append(query, byte(qtype>>8), byte(qtype), 0, 1)
+
+	msg, err := dnsExchange(server, query, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// TCP应答的长度由对端给出，不能假设包含完整的头部
+	if len(msg) < 12 {
+		return nil, errors.New("dns response too short")
+	}
+	if binary.BigEndian.Uint16(msg) != binary.BigEndian.Uint16(query) {
+		return nil, errors.New("dns response id mismatch")
+	}
+
+	rcode := msg[3] & 0x0F
+	if rcode != 0 {
+		return nil, fmt.Errorf("dns query %s failed, rcode %d", name, rcode)
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	count := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, off, err = dnsUnpackName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	var output []dnsRecord
+	for i := 0; i < count; i++ {
+		var record dnsRecord
+		record.Name, off, err = dnsUnpackName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errors.New("dns record overflow")
+		}
+		record.Type = binary.BigEndian.Uint16(msg[off:])
+		record.TTL = binary.BigEndian.Uint32(msg[off+4:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, errors.New("dns record overflow")
+		}
+		rdata := msg[off : off+length]
+
+		switch record.Type {
+		case DNS_TYPE_A, DNS_TYPE_AAAA:
+			record.IP = net.IP(append([]byte(nil), rdata...))
+		case DNS_TYPE_SRV:
+			if length < 7 {
+				return nil, errors.New("dns srv record overflow")
+			}
+			record.Priority = binary.BigEndian.Uint16(rdata)
+			record.Weight = binary.BigEndian.Uint16(rdata[2:])
+			record.Port = binary.BigEndian.Uint16(rdata[4:])
+			record.Target, _, err = dnsUnpackName(msg, off+6)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			off += length
+			continue
+		}
+		off += length
+		output = append(output, record)
+	}
+	return output, nil
+}
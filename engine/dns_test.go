@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 在同一端口上提供UDP和TCP查询的测试DNS服务器。truncate 中的域名通过UDP查询时
+// 返回截断的应答，short 中的域名通过TCP查询时返回不足头部长度的应答。
+type dnsStub struct {
+	sync.Mutex
+
+	udp      net.PacketConn
+	tcp      net.Listener
+	records  map[string][]dnsRecord
+	truncate map[string]bool
+	short    map[string]bool
+	tcpCount int
+}
+
+func newDnsStub(t *testing.T) *dnsStub {
+	s := &dnsStub{records: make(map[string][]dnsRecord),
+		truncate: make(map[string]bool), short: make(map[string]bool)}
+
+	var err error
+	for i := 0; i < 10; i++ {
+		s.udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		s.udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *dnsStub) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *dnsStub) Add(r dnsRecord) {
+	s.Lock()
+	defer s.Unlock()
+	key := strings.ToLower(r.Name)
+	s.records[key] = append(s.records[key], r)
+}
+
+func (s *dnsStub) Truncate(name string, short bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.truncate[name] = true
+	s.short[name] = short
+}
+
+func (s *dnsStub) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		cnt, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := s.answer(buf[:cnt], false)
+		if resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnsStub) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var head [2]byte
+			if _, err := io.ReadFull(conn, head[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(head[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			s.Lock()
+			s.tcpCount++
+			s.Unlock()
+			resp := s.answer(query, true)
+			body := make([]byte, 2, 2+len(resp))
+			binary.BigEndian.PutUint16(body, uint16(len(resp)))
+			conn.Write(append(body, resp...))
+		}()
+	}
+}
+
+func (s *dnsStub) answer(query []byte, tcp bool) []byte {
+	name, off, err := dnsUnpackName(query, 12)
+	if err != nil || off+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[off:])
+	question := query[12 : off+4]
+
+	s.Lock()
+	defer s.Unlock()
+
+	key := strings.ToLower(name)
+	if tcp && s.short[key] {
+		return query[:6]
+	}
+
+	var answers []dnsRecord
+	for _, r := range s.records[key] {
+		if r.Type == qtype {
+			answers = append(answers, r)
+			// 附加区带上SRV目标的地址
+			if r.Type == DNS_TYPE_SRV {
+				answers = append(answers, s.records[strings.ToLower(r.Target)]...)
+			}
+		}
+	}
+
+	flags := uint16(0x8180)
+	if !tcp && s.truncate[key] {
+		flags |= 0x0200
+		answers = nil
+	}
+
+	msg := make([]byte, 12, 512)
+	copy(msg, query[:2])
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	msg = append(msg, question...)
+
+	for _, r := range answers {
+		msg, _ = dnsPackName(msg, r.Name)
+		var rdata []byte
+		switch r.Type {
+		case DNS_TYPE_A:
+			rdata = r.IP.To4()
+		case DNS_TYPE_AAAA:
+			rdata = r.IP.To16()
+		case DNS_TYPE_SRV:
+			rdata = []byte{byte(r.Priority >> 8), byte(r.Priority), byte(r.Weight >> 8), byte(r.Weight),
+				byte(r.Port >> 8), byte(r.Port)}
+			rdata, _ = dnsPackName(rdata, r.Target)
+		}
+		var head [10]byte
+		binary.BigEndian.PutUint16(head[0:], r.Type)
+		binary.BigEndian.PutUint16(head[2:], 1)
+		binary.BigEndian.PutUint32(head[4:], r.TTL)
+		binary.BigEndian.PutUint16(head[8:], uint16(len(rdata)))
+		msg = append(msg, head[:]...)
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func TestDnsQueryA(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.Add(dnsRecord{Name: "a.test", Type: DNS_TYPE_A, TTL: 60, IP: net.ParseIP("192.0.2.1")})
+	stub.Add(dnsRecord{Name: "a.test", Type: DNS_TYPE_AAAA, TTL: 30, IP: net.ParseIP("2001:db8::1")})
+
+	records, err := dnsQuery(stub.Addr(), "a.test", DNS_TYPE_A, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].IP.Equal(net.ParseIP("192.0.2.1")) || records[0].TTL != 60 {
+		t.Fatalf("unexpected A answer %+v", records)
+	}
+
+	records, err = dnsQuery(stub.Addr(), "a.test", DNS_TYPE_AAAA, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].IP.Equal(net.ParseIP("2001:db8::1")) || records[0].TTL != 30 {
+		t.Fatalf("unexpected AAAA answer %+v", records)
+	}
+}
+
+func TestDnsQueryTruncated(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.Add(dnsRecord{Name: "big.test", Type: DNS_TYPE_A, TTL: 60, IP: net.ParseIP("192.0.2.2")})
+	stub.Truncate("big.test", false)
+
+	records, err := dnsQuery(stub.Addr(), "big.test", DNS_TYPE_A, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].IP.Equal(net.ParseIP("192.0.2.2")) {
+		t.Fatalf("unexpected answer after tcp retry %+v", records)
+	}
+	stub.Lock()
+	count := stub.tcpCount
+	stub.Unlock()
+	if count != 1 {
+		t.Fatalf("truncated answer retried over tcp %d times", count)
+	}
+}
+
+func TestDnsQueryShortResponse(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.Truncate("short.test", true)
+
+	_, err := dnsQuery(stub.Addr(), "short.test", DNS_TYPE_A, time.Second)
+	if err == nil {
+		t.Fatal("short tcp response accepted")
+	}
+}
+
+func dnsSourceAddrs(b *Balancer) []string {
+	var output []string
+	for _, e := range b.Endpoints() {
+		output = append(output, e.Address)
+	}
+	sort.Strings(output)
+	return output
+}
+
+func TestDnsSourceHost(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.Add(dnsRecord{Name: "svc.test", Type: DNS_TYPE_A, TTL: 60, IP: net.ParseIP("192.0.2.10")})
+	stub.Add(dnsRecord{Name: "svc.test", Type: DNS_TYPE_AAAA, TTL: 20, IP: net.ParseIP("2001:db8::10")})
+
+	cluster := &ClusterConfig{Name: "dns-host", Resolver: stub.Addr()}
+	b := NewBalancer(cluster)
+	d := NewDnsSource(b, cluster, 0, EndpointConfig{Address: "dns://svc.test:8080"})
+
+	want := []string{"192.0.2.10:8080", "[2001:db8::10]:8080"}
+	if got := dnsSourceAddrs(b); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("endpoints %v, want %v", got, want)
+	}
+
+	// 按最小的TTL刷新
+	if wait := d.refresh(); wait != 20*time.Second {
+		t.Fatalf("refresh after %s, want 20s", wait)
+	}
+}
+
+func TestDnsSourceSRV(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.Add(dnsRecord{Name: "_app._tcp.test", Type: DNS_TYPE_SRV, TTL: 120,
+		Priority: 1, Weight: 1, Port: 9000, Target: "node1.test"})
+	stub.Add(dnsRecord{Name: "_app._tcp.test", Type: DNS_TYPE_SRV, TTL: 120,
+		Priority: 1, Weight: 1, Port: 9001, Target: "node2.test"})
+	stub.Add(dnsRecord{Name: "node1.test", Type: DNS_TYPE_A, TTL: 90, IP: net.ParseIP("192.0.2.21")})
+	stub.Add(dnsRecord{Name: "node2.test", Type: DNS_TYPE_A, TTL: 90, IP: net.ParseIP("192.0.2.22")})
+
+	cluster := &ClusterConfig{Name: "dns-srv", Resolver: stub.Addr()}
+	b := NewBalancer(cluster)
+	d := NewDnsSource(b, cluster, 0, EndpointConfig{Address: "srv://_app._tcp.test"})
+
+	want := []string{"192.0.2.21:9000", "192.0.2.22:9001"}
+	if got := dnsSourceAddrs(b); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("endpoints %v, want %v", got, want)
+	}
+	if wait := d.refresh(); wait != 90*time.Second {
+		t.Fatalf("refresh after %s, want 90s", wait)
+	}
+}
+
+func TestDnsSourceTTLBounds(t *testing.T) {
+	stub := newDnsStub(t)
+	stub.Add(dnsRecord{Name: "low.test", Type: DNS_TYPE_A, TTL: 1, IP: net.ParseIP("192.0.2.31")})
+	stub.Add(dnsRecord{Name: "high.test", Type: DNS_TYPE_A, TTL: 86400, IP: net.ParseIP("192.0.2.32")})
+
+	cases := map[string]time.Duration{"low.test": dnsMinInterval, "high.test": dnsMaxInterval}
+	for host, want := range cases {
+		cluster := &ClusterConfig{Name: "dns-" + host, Resolver: stub.Addr()}
+		d := NewDnsSource(NewBalancer(cluster), cluster, 0, EndpointConfig{Address: "dns://" + host + ":80"})
+		if wait := d.refresh(); wait != want {
+			t.Errorf("%s refresh after %s, want %s", host, wait, want)
+		}
+	}
+
+	// 解析失败时保留上一次的结果
+	cluster := &ClusterConfig{Name: "dns-keep", Resolver: stub.Addr()}
+	b := NewBalancer(cluster)
+	d := NewDnsSource(b, cluster, 0, EndpointConfig{Address: "dns://low.test:80"})
+	stub.Lock()
+	delete(stub.records, "low.test")
+	stub.Unlock()
+	if wait := d.refresh(); wait != dnsMinInterval {
+		t.Errorf("failed refresh after %s, want %s", wait, dnsMinInterval)
+	}
+	if got := dnsSourceAddrs(b); len(got) != 1 || got[0] != "192.0.2.31:80" {
+		t.Errorf("endpoints after failed refresh %v", got)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type EndpointFileItem struct {
+	Address string `json:"address" yaml:"address"`
+	Weight  int    `json:"weight" yaml:"weight"`
+	Tier    int    `json:"tier" yaml:"tier"`
+}
+
+// 外部服务发现写入的后端列表文件，定时检查变化后整体替换。
+// 支持纯文本(每行一个地址，可附加 weight=N tier=N)、JSON和YAML三种格式。
+type FileSource struct {
+	balancer *Balancer
+	filename string
+	interval time.Duration
+	modtime  time.Time
+	body     []byte
+}
+
+func NewFileSource(b *Balancer, cluster *ClusterConfig) *FileSource {
+	f := &FileSource{balancer: b, filename: cluster.EndpointFile, interval: 5 * time.Second}
+	if cluster.EndpointInterval > 0 {
+		f.interval = time.Duration(cluster.EndpointInterval) * time.Second
+	}
+
+	f.refresh()
+	go f.run()
+
+	return f
+}
+
+func (f *FileSource) run() {
+	for {
+		time.Sleep(f.interval)
+		f.refresh()
+	}
+}
+
+func (f *FileSource) refresh() {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		log.Printf("cluster %s endpoint file %s", f.balancer.Name, err.Error())
+		return
+	}
+	if info.ModTime().Equal(f.modtime) {
+		return
+	}
+
+	body, err := ioutil.ReadFile(f.filename)
+	if err != nil {
+		log.Printf("cluster %s endpoint file %s", f.balancer.Name, err.Error())
+		return
+	}
+	f.modtime = info.ModTime()
+	if bytes.Equal(body, f.body) {
+		return
+	}
+
+	list, err := endpointFileParse(f.filename, body)
+	if err != nil {
+		log.Printf("cluster %s endpoint file %s rejected, keep last endpoints, %s",
+			f.balancer.Name, f.filename, err.Error())
+		return
+	}
+	f.body = body
+
+	log.Printf("cluster %s endpoint file %s load %d endpoints", f.balancer.Name, f.filename, len(list))
+	f.balancer.Update("file://"+f.filename, list)
+}
+
+func endpointFileParse(filename string, body []byte) ([]*Endpoint, error) {
+	var items []EndpointFileItem
+	var err error
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(body, &items)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(body, &items)
+	default:
+		items, err = endpointFileParseText(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 文件可能正在被写入，空列表按异常处理
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no endpoint")
+	}
+
+	var list []*Endpoint
+	for _, v := range items {
+		_, port, err := net.SplitHostPort(v.Address)
+		if err != nil {
+			return nil, err
+		}
+		_, err = strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("address %s invalid port", v.Address)
+		}
+		if v.Weight < 0 || v.Tier < 0 || v.Tier > endpointMaxTier {
+			return nil, fmt.Errorf("address %s invalid weight or tier", v.Address)
+		}
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+		list = append(list, &Endpoint{Address: v.Address, Weight: v.Weight, Priority: v.Tier})
+	}
+	return list, nil
+}
+
+func endpointFileParseText(body []byte) ([]EndpointFileItem, error) {
+	var items []EndpointFileItem
+	for i, line := range strings.Split(string(body), "\n") {
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		item := EndpointFileItem{Address: fields[0]}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %d: invalid option %s", i+1, field)
+			}
+			value, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid option %s", i+1, field)
+			}
+			switch kv[0] {
+			case "weight":
+				item.Weight = value
+			case "tier":
+				item.Tier = value
+			default:
+				return nil, fmt.Errorf("line %d: unknown option %s", i+1, kv[0])
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
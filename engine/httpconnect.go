@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HttpConnectConfig struct {
+	Users   []ProxyUser `yaml:"users"`
+	Forward bool        `yaml:"forward"`
+}
+
+// HTTP CONNECT代理服务端，非CONNECT请求在开启forward时转发到监听的集群。
+type HttpConnectServer struct {
+	users   map[string]string
+	forward bool
+	policy  *Policy
+	dialer  *Dialer
+	tls     *tls.Config
+}
+
+func NewHttpConnectServer(cfg *HttpConnectConfig, policy *Policy, dialer *Dialer, remotetls *tls.Config) *HttpConnectServer {
+	s := &HttpConnectServer{users: make(map[string]string), policy: policy, dialer: dialer, tls: remotetls}
+	if cfg != nil {
+		s.forward = cfg.Forward
+		for _, v := range cfg.Users {
+			s.users[v.Username] = v.Password
+		}
+	}
+	return s
+}
+
+func httpReply(conn net.Conn, code int, header string) error {
+	status := fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	if code != http.StatusOK {
+		header += "Content-Length: 0\r\nConnection: close\r\n"
+	}
+	_, err := conn.Write([]byte(status + header + "\r\n"))
+	return err
+}
+
+func (s *HttpConnectServer) auth(req *http.Request) bool {
+	if len(s.users) == 0 {
+		return true
+	}
+	value := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(strings.ToLower(value), "basic ") {
+		return false
+	}
+	decode, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[6:]))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decode), ":")
+	if !ok {
+		return false
+	}
+	password, ok := s.users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(pass)) == 1
+}
+
+// 策略拒绝返回403，域名解析失败返回502，解析超时返回504
+func policyStatus(err error) int {
+	var dnserr *net.DNSError
+	if errors.As(err, &dnserr) {
+		if dnserr.IsTimeout {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusBadGateway
+	}
+	return http.StatusForbidden
+}
+
+// 校验代理认证并去掉只对代理有效的头部，失败时已应答客户端
+func (s *HttpConnectServer) accept(localconn net.Conn, req *http.Request) bool {
+	if !s.auth(req) {
+		log.Printf("%s http proxy authentication failed", localconn.RemoteAddr().String())
+		httpReply(localconn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"tcpproxy\"\r\n")
+		return false
+	}
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	return true
+}
+
+func (s *HttpConnectServer) Serve(t *TcpProxy, localconn net.Conn) {
+	defer localconn.Close()
+
+	localconn.SetDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReader(localconn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		httpReply(localconn, http.StatusBadRequest, "")
+		return
+	}
+
+	if !s.accept(localconn, req) {
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		s.proxyRequest(t, localconn, reader, req)
+		return
+	}
+	s.connect(localconn, reader, req)
+}
+
+func (s *HttpConnectServer) connect(localconn net.Conn, reader *bufio.Reader, req *http.Request) {
+	host, portstr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		httpReply(localconn, http.StatusBadRequest, "")
+		return
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		httpReply(localconn, http.StatusBadRequest, "")
+		return
+	}
+
+	address, err := s.policy.Resolve(host, port)
+	if err != nil {
+		log.Printf("%s http connect %s, %s", localconn.RemoteAddr().String(), req.Host, err.Error())
+		httpReply(localconn, policyStatus(err), "")
+		return
+	}
+
+	remoteconn, err := s.dialer.Dial(address, 10*time.Second)
+	if err != nil {
+		log.Printf("%s http connect %s, %s", localconn.RemoteAddr().String(), req.Host, err.Error())
+		httpReply(localconn, http.StatusBadGateway, "")
+		return
+	}
+
+	err = httpReply(localconn, http.StatusOK, "")
+	if err != nil {
+		remoteconn.Close()
+		return
+	}
+	localconn.SetDeadline(time.Time{})
+
+	if s.tls != nil {
+		remotetls := s.tls.Clone()
+		remotetls.ServerName = host
+		remoteconn = tls.Client(remoteconn, remotetls)
+	}
+
+	// 请求之后已读入缓冲的数据需要继续转发
+	log.Println("http connect to ", req.Host)
+	tcpProxyProcess(&bufferedConn{Conn: localconn, reader: reader}, remoteconn, nil)
+}
+
+// 普通代理请求逐个读取，每个请求都校验认证并把绝对URI改写为路径形式后发给后端，
+// 复用同一个后端连接。中途出现CONNECT时改为隧道。
+func (s *HttpConnectServer) proxyRequest(t *TcpProxy, localconn net.Conn, reader *bufio.Reader, req *http.Request) {
+	if !s.forward || t.Remote == nil {
+		httpReply(localconn, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return
+	}
+	localconn.SetDeadline(time.Time{})
+
+	client := localconn.RemoteAddr().String()
+	backend := &httpBackend{proxy: t}
+	defer backend.Close()
+
+	for {
+		if backend.conn == nil {
+			backend.conn, backend.endpoint = t.dial(t.Remote.AffinityKey(localconn))
+			if backend.conn == nil {
+				httpReply(localconn, http.StatusBadGateway, "")
+				return
+			}
+			backend.reader = bufio.NewReader(backend.conn)
+		}
+
+		now := time.Now()
+		status, keepalive, err := httpExchange(localconn, reader, backend, req)
+		if err != nil {
+			log.Printf("%s %s %s%s %s", client, req.Method, req.Host, req.URL.Path, err.Error())
+			return
+		}
+		log.Printf("%s %s %s%s %d %v", client, req.Method, req.Host, req.URL.Path, status, time.Since(now))
+		if !keepalive {
+			return
+		}
+
+		localconn.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		localconn.SetReadDeadline(time.Time{})
+
+		if !s.accept(localconn, req) {
+			return
+		}
+		if req.Method == http.MethodConnect {
+			backend.Close()
+			localconn.SetDeadline(time.Now().Add(30 * time.Second))
+			s.connect(localconn, reader, req)
+			return
+		}
+	}
+}
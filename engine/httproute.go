@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 客户端在两个请求之间的最长空闲时间
+const httpIdleTimeout = 60 * time.Second
+
+type HttpRouteConfig struct {
+	Host    string `yaml:"host"`
+	Path    string `yaml:"path"`
+	Cluster string `yaml:"cluster"`
+}
+
+type HttpConfig struct {
+	Routes []HttpRouteConfig `yaml:"routes"`
+}
+
+type httpRoute struct {
+	host  string
+	wild  bool
+	path  string
+	proxy *TcpProxy
+}
+
+func (r *httpRoute) match(host string, path string) bool {
+	if r.wild {
+		if !strings.HasSuffix(host, r.host) {
+			return false
+		}
+	} else if r.host != "" && host != r.host {
+		return false
+	}
+	return strings.HasPrefix(path, r.path)
+}
+
+// HTTP/1.x感知的转发，按Host和路径前缀在每个请求边界重新选择集群。
+// 非HTTP流量以及没有匹配的请求走listener的默认集群。
+type HttpRouter struct {
+	routes   []*httpRoute
+	fallback *TcpProxy
+}
+
+func NewHttpRouter(cfg *HttpConfig, fallback *TcpProxy) *HttpRouter {
+	h := &HttpRouter{fallback: fallback}
+	if cfg == nil {
+		return h
+	}
+	for _, v := range cfg.Routes {
+		route := &httpRoute{host: strings.ToLower(v.Host), path: v.Path}
+		if strings.HasPrefix(route.host, "*.") {
+			route.host, route.wild = route.host[1:], true
+		}
+		h.routes = append(h.routes, route)
+	}
+	return h
+}
+
+func (h *HttpRouter) route(req *http.Request) *TcpProxy {
+	host := strings.ToLower(req.Host)
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	for _, v := range h.routes {
+		if v.match(host, req.URL.Path) {
+			return v.proxy
+		}
+	}
+	return h.fallback
+}
+
+// 统计经过的字节数
+type countWriter struct {
+	writer io.Writer
+	up     bool
+}
+
+func (w *countWriter) Write(buf []byte) (int, error) {
+	cnt, err := w.writer.Write(buf)
+	if w.up {
+		Add(cnt, 0)
+	} else {
+		Add(0, cnt)
+	}
+	return cnt, err
+}
+
+type httpBackend struct {
+	proxy    *TcpProxy
+	conn     net.Conn
+	reader   *bufio.Reader
+	endpoint *Endpoint
+}
+
+func (b *httpBackend) Close() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.proxy.Remote.Release(b.endpoint)
+		b.conn = nil
+	}
+}
+
+func httpForwarded(req *http.Request, client string, proto string) {
+	prior := req.Header.Values("X-Forwarded-For")
+	req.Header.Set("X-Forwarded-For", strings.Join(append(prior, client), ", "))
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	node := client
+	if strings.Contains(client, ":") {
+		node = "\"[" + client + "]\""
+	}
+	forwarded := "for=" + node + ";proto=" + proto
+	if req.Host != "" {
+		forwarded += ";host=\"" + req.Host + "\""
+	}
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
+}
+
+func (h *HttpRouter) Serve(localconn net.Conn) {
+	defer localconn.Close()
+
+	proto := "http"
+	if _, ok := localconn.(*tls.Conn); ok {
+		proto = "https"
+	}
+	client, _, _ := net.SplitHostPort(localconn.RemoteAddr().String())
+
+	reader := bufio.NewReader(localconn)
+	backend := new(httpBackend)
+	defer backend.Close()
+
+	for first := true; ; first = false {
+		localconn.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+
+		// 首个请求不是HTTP时整条连接按原始字节转发到默认集群
+		if first && !h.sniff(reader) {
+			localconn.SetReadDeadline(time.Time{})
+			if reader.Buffered() > 0 {
+				h.raw(&bufferedConn{Conn: localconn, reader: reader})
+			}
+			return
+		}
+
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF && !first {
+				log.Printf("%s %s", localconn.RemoteAddr().String(), err.Error())
+			}
+			return
+		}
+		localconn.SetReadDeadline(time.Time{})
+
+		route := h.route(req)
+		if route == nil {
+			httpReply(localconn, http.StatusBadGateway, "")
+			return
+		}
+
+		// 路由变化时关闭旧的后端连接
+		if backend.proxy != route {
+			backend.Close()
+			backend.proxy = route
+		}
+		if backend.conn == nil {
+			backend.conn, backend.endpoint = route.dial(route.Remote.AffinityKey(localconn))
+			if backend.conn == nil {
+				httpReply(localconn, http.StatusBadGateway, "")
+				return
+			}
+			backend.reader = bufio.NewReader(backend.conn)
+		}
+
+		httpForwarded(req, client, proto)
+
+		now := time.Now()
+		status, keepalive, err := httpExchange(localconn, reader, backend, req)
+		if err != nil {
+			log.Printf("%s %s %s%s %s", client, req.Method, req.Host, req.URL.Path, err.Error())
+			return
+		}
+		log.Printf("%s %s %s%s %d %v", client, req.Method, req.Host, req.URL.Path, status, time.Since(now))
+		if !keepalive {
+			return
+		}
+	}
+}
+
+// 判断连接的首个请求是否为HTTP，数据不足时继续读取
+func (h *HttpRouter) sniff(reader *bufio.Reader) bool {
+	for size := 1; ; size++ {
+		head, err := reader.Peek(size)
+		matched, more := matchPrefix(head, sniffMethods)
+		if matched || !more || err != nil {
+			return matched
+		}
+	}
+}
+
+// 转发一次请求和应答，返回应答状态码以及客户端连接能否继续复用
+func httpExchange(localconn net.Conn, reader *bufio.Reader, backend *httpBackend, req *http.Request) (int, bool, error) {
+	err := req.Write(&countWriter{writer: backend.conn, up: true})
+	if err != nil {
+		backend.Close()
+		httpReply(localconn, http.StatusBadGateway, "")
+		return 0, false, err
+	}
+
+	var resp *http.Response
+	for {
+		resp, err = http.ReadResponse(backend.reader, req)
+		if err != nil {
+			backend.Close()
+			httpReply(localconn, http.StatusBadGateway, "")
+			return 0, false, err
+		}
+		// 100 Continue等中间应答直接转给客户端
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		resp.Write(localconn)
+	}
+
+	err = resp.Write(&countWriter{writer: localconn})
+	resp.Body.Close()
+	if err != nil {
+		backend.Close()
+		return 0, false, err
+	}
+
+	// 协议升级(如websocket)之后双向原样转发
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		tcpProxyProcess(&bufferedConn{Conn: localconn, reader: reader},
+			&bufferedConn{Conn: backend.conn, reader: backend.reader}, nil)
+		backend.Close()
+		return resp.StatusCode, false, nil
+	}
+
+	if resp.Close {
+		backend.Close()
+	}
+	return resp.StatusCode, !req.Close, nil
+}
+
+func (h *HttpRouter) raw(localconn net.Conn) {
+	if h.fallback == nil {
+		return
+	}
+	remoteconn, endpoint := h.fallback.dial(h.fallback.Remote.AffinityKey(localconn))
+	if remoteconn == nil {
+		return
+	}
+	defer h.fallback.Remote.Release(endpoint)
+
+	tcpProxyProcess(localconn, remoteconn, nil)
+}
+
+func httpRouterBuild(v ListernerConfig) *HttpRouter {
+	var fallback *TcpProxy
+	if v.Cluster != "" {
+		fallback = clusterRoute(v, v.Cluster)
+	}
+
+	router := NewHttpRouter(v.Http, fallback)
+	for i, route := range router.routes {
+		route.proxy = clusterRoute(v, v.Http.Routes[i].Cluster)
+	}
+	return router
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ${VAR}、${VAR:-default}、${file:/path/to/secret}，文件相对路径基于配置文件所在目录。
+var interpolateRegexp = regexp.MustCompile(`\$\{([^}:]+)(:-([^}]*)|:([^}]*))?\}`)
+
+// 解析前把每个引用换成占位符：占位符单独作为不加引号的值时YAML解析为整数，
+// 加了引号或嵌在其他文本中时仍是字符串，由此区分引用是否带引号。
+const interpolateMark = 0x7e5f00000000
+
+var interpolateMarkRegexp = regexp.MustCompile(`0x7e5f[0-9a-f]{8}`)
+
+type interpolator struct {
+	filename string
+	refs     []string
+	errs     []string
+}
+
+// 按YAML解析到config后再替换字符串字段中的引用，注释中的引用不处理，
+// 替换的值不再经过YAML解析，包含冒号、引号、换行(如PEM证书)或0123、yes等都原样使用。
+// 不加引号、整个值就是一个引用的数字和布尔字段按YAML规则转换类型，端口等字段也可以引用环境变量。
+func interpolate(filename string, body []byte, config *GlobalConfig) error {
+	p := &interpolator{filename: filename}
+	body = interpolateRegexp.ReplaceAllFunc(body, func(match []byte) []byte {
+		p.refs = append(p.refs, string(match))
+		return []byte(fmt.Sprintf("%#x", interpolateMark+len(p.refs)-1))
+	})
+
+	var raw yaml.MapSlice
+	err := yaml.Unmarshal(body, &raw)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, p.restore(err.Error()))
+	}
+	typed := make(map[string]string)
+	p.scan(raw, reflect.TypeOf(*config), typed)
+	for mark, literal := range typed {
+		body = bytes.Replace(body, []byte(mark), []byte(literal), 1)
+	}
+
+	err = yaml.Unmarshal(body, config)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, p.restore(err.Error()))
+	}
+	p.expand(reflect.ValueOf(config).Elem())
+	if len(p.errs) > 0 {
+		return fmt.Errorf("%s: %s", filename, strings.Join(p.errs, "; "))
+	}
+	return nil
+}
+
+// 找出不加引号、对应数字或布尔字段的引用，替换为转换后的YAML值；
+// 无法转换时替换为字符串，由YAML报告类型错误。target未知时为nil。
+func (p *interpolator) scan(value interface{}, target reflect.Type, typed map[string]string) {
+	for target != nil && target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+	switch v := value.(type) {
+	case int, int64:
+		mark := fmt.Sprintf("%#x", v)
+		ref := p.ref(mark)
+		if ref == "" || target == nil {
+			return
+		}
+		switch target.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			output := p.replace(ref)
+			var result interface{}
+			if yaml.Unmarshal([]byte(output), &result) == nil {
+				switch result.(type) {
+				case int, int64, uint64, float64, bool:
+					typed[mark] = fmt.Sprint(result)
+					return
+				}
+			}
+			typed[mark] = strconv.Quote(output)
+		}
+	case yaml.MapSlice:
+		for _, item := range v {
+			key, _ := item.Key.(string)
+			p.scan(item.Value, fieldType(target, key), typed)
+		}
+	case []interface{}:
+		var elem reflect.Type
+		if target != nil && target.Kind() == reflect.Slice {
+			elem = target.Elem()
+		}
+		for _, item := range v {
+			p.scan(item, elem, typed)
+		}
+	}
+}
+
+// 替换解析结果中所有字符串里的占位符，包括map的键。
+func (p *interpolator) expand(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			p.expand(value.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).IsExported() {
+				p.expand(value.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			p.expand(value.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			name := reflect.New(key.Type()).Elem()
+			name.Set(key)
+			p.expand(name)
+			item := reflect.New(value.Type().Elem()).Elem()
+			item.Set(value.MapIndex(key))
+			p.expand(item)
+			value.SetMapIndex(key, reflect.Value{})
+			value.SetMapIndex(name, item)
+		}
+	case reflect.String:
+		value.SetString(interpolateMarkRegexp.ReplaceAllStringFunc(value.String(), func(mark string) string {
+			return p.replace(p.ref(mark))
+		}))
+	}
+}
+
+// 占位符对应的原始引用，不是占位符时返回空。
+func (p *interpolator) ref(mark string) string {
+	if !interpolateMarkRegexp.MatchString(mark) {
+		return ""
+	}
+	index, _ := strconv.ParseInt(mark, 0, 64)
+	index -= interpolateMark
+	if index < 0 || index >= int64(len(p.refs)) {
+		return mark
+	}
+	return p.refs[index]
+}
+
+// 错误信息中的占位符还原为原始引用。
+func (p *interpolator) restore(text string) string {
+	return interpolateMarkRegexp.ReplaceAllStringFunc(text, p.ref)
+}
+
+// 按yaml标签找到结构体字段的类型，inline的字段展开查找。
+func fieldType(target reflect.Type, key string) reflect.Type {
+	if target == nil {
+		return nil
+	}
+	switch target.Kind() {
+	case reflect.Map:
+		return target.Elem()
+	case reflect.Struct:
+	default:
+		return nil
+	}
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			if found := fieldType(field.Type, key); found != nil {
+				return found
+			}
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if name == key {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+func (p *interpolator) replace(match string) string {
+	sub := interpolateRegexp.FindStringSubmatch(match)
+	name := sub[1]
+
+	// 从文件读取密钥等敏感信息，去掉末尾换行
+	if name == "file" && len(sub[4]) > 0 {
+		path := sub[4]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(p.filename), path)
+		}
+		secret, err := os.ReadFile(path)
+		if err != nil {
+			p.errs = append(p.errs, err.Error())
+			return match
+		}
+		return strings.TrimRight(string(secret), "\r\n")
+	}
+
+	if len(sub[4]) > 0 {
+		p.errs = append(p.errs, fmt.Sprintf("unknown reference %s", match))
+		return match
+	}
+
+	value, ok := os.LookupEnv(name)
+	if ok && value != "" {
+		return value
+	}
+	if len(sub[2]) > 0 {
+		return sub[3]
+	}
+	if !ok {
+		p.errs = append(p.errs, fmt.Sprintf("environment variable %s not set", name))
+	}
+	return value
+}
+
+// include支持单个文件、目录(目录下全部yaml文件)以及通配符，相对路径基于当前配置文件所在目录。
+func includeFiles(base string, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(base), pattern)
+	}
+
+	info, err := os.Stat(pattern)
+	if err == nil && info.IsDir() {
+		var files []string
+		for _, ext := range []string{"*.yaml", "*.yml"} {
+			list, _ := filepath.Glob(filepath.Join(pattern, ext))
+			files = append(files, list...)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	if err == nil {
+		return []string{pattern}, nil
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: include %s not found", base, pattern)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+type configLoader struct {
+	config  *GlobalConfig
+	loading map[string]bool
+	origin  map[string]string
+}
+
+func (l *configLoader) load(filename string) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if l.loading[abs] {
+		return fmt.Errorf("%s: include loop", filename)
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	config := new(GlobalConfig)
+	err = interpolate(filename, body, config)
+	if err != nil {
+		return err
+	}
+
+	err = l.merge(filename, config)
+	if err != nil {
+		return err
+	}
+
+	for _, pattern := range config.Include {
+		files, err := includeFiles(filename, pattern)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			err = l.load(file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) claim(kind string, name string, filename string) error {
+	key := kind + "/" + name
+	if first, ok := l.origin[key]; ok {
+		return fmt.Errorf("%s %s defined in both %s and %s", kind, name, first, filename)
+	}
+	l.origin[key] = filename
+	return nil
+}
+
+// 按监听地址、集群名称和TLS名称合并，重复定义报错。
+// cert_expiry、metrics 和 maintenance_file 只能在一个文件中定义。
+func (l *configLoader) merge(filename string, config *GlobalConfig) error {
+	if config.CertExpiry != nil {
+		err := l.claim("section", "cert_expiry", filename)
+		if err != nil {
+			return err
+		}
+		l.config.CertExpiry = config.CertExpiry
+	}
+	if config.Metrics != "" {
+		err := l.claim("section", "metrics", filename)
+		if err != nil {
+			return err
+		}
+		l.config.Metrics = config.Metrics
+	}
+	if config.MaintenanceFile != "" {
+		err := l.claim("section", "maintenance_file", filename)
+		if err != nil {
+			return err
+		}
+		l.config.MaintenanceFile = config.MaintenanceFile
+	}
+	for _, v := range config.Listeners {
+		err := l.claim("listener", v.Address, filename)
+		if err != nil {
+			return err
+		}
+		l.config.Listeners = append(l.config.Listeners, v)
+	}
+	for _, v := range config.Clusters {
+		err := l.claim("cluster", v.Name, filename)
+		if err != nil {
+			return err
+		}
+		l.config.Clusters = append(l.config.Clusters, v)
+	}
+	for _, v := range config.TlsCfg {
+		err := l.claim("tls", v.Name, filename)
+		if err != nil {
+			return err
+		}
+		l.config.TlsCfg = append(l.config.TlsCfg, v)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, body string) error {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte(body), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(file)
+}
+
+func TestInterpolateKeepsStrings(t *testing.T) {
+	t.Setenv("TEST_PASSWORD", "0123")
+	t.Setenv("TEST_YES", "yes")
+	t.Setenv("TEST_HEX", "0x10")
+	t.Setenv("TEST_NUMBER", "600")
+	t.Setenv("TEST_PORT", "8080")
+	t.Setenv("TEST_PEM", "-----BEGIN X-----\nkey: value # not a comment\n-----END X-----")
+
+	err := loadTestConfig(t, `
+listeners:
+  - address: 127.0.0.1:${TEST_PORT}
+    cluster: backend
+    acceptors: ${TEST_NUMBER}
+clusters:
+  - name: backend
+    endpoints: [127.0.0.1:${TEST_PORT}]
+    proxy_timeout: ${TEST_UNSET:-30}
+tls:
+  - name: plain
+    password: ${TEST_PASSWORD}
+    ocsp_staple: ${TEST_YES}
+    crl_refresh: ${TEST_HEX}
+  - name: yes
+    password: ${TEST_YES}
+    password_env: "${TEST_NUMBER}"
+  - name: quoted
+    password: '${TEST_HEX}'
+    cert: ${TEST_PEM}
+  - name: literal
+    password: 0123
+    # password_file: ${TEST_UNSET}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := globalconfig.Listeners[0]
+	if listener.Address != "127.0.0.1:8080" || listener.Acceptors != 600 {
+		t.Fatalf("listener %+v", listener)
+	}
+	if cluster := ClusterGet("backend"); cluster.ProxyTimeout != 30 {
+		t.Fatalf("proxy_timeout %d", cluster.ProxyTimeout)
+	}
+
+	plain := TlsGet("plain")
+	if plain.Password != "0123" || !plain.OcspStaple || plain.CRLRefresh != 16 {
+		t.Fatalf("tls plain %+v", plain)
+	}
+	yes := TlsGet("yes")
+	if yes.Password != "yes" || yes.PasswordEnv != "600" {
+		t.Fatalf("tls yes %+v", yes)
+	}
+	if quoted := TlsGet("quoted"); quoted.Password != "0x10" || quoted.Cert != os.Getenv("TEST_PEM") {
+		t.Fatalf("tls quoted %+v", quoted)
+	}
+	if literal := TlsGet("literal"); literal.Password != "0123" {
+		t.Fatalf("tls literal %+v", literal)
+	}
+}
+
+func TestInterpolateQuotedNumber(t *testing.T) {
+	t.Setenv("TEST_NUMBER", "600")
+
+	// 加了引号的引用是字符串，不能用于数字字段
+	err := loadTestConfig(t, `
+listeners:
+  - address: 127.0.0.1:8080
+    acceptors: "${TEST_NUMBER}"
+`)
+	if err == nil || !strings.Contains(err.Error(), "cannot unmarshal !!str") {
+		t.Fatalf("quoted reference in a number field returned %v", err)
+	}
+}
@@ -3,22 +3,49 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 )
 
 var (
-	config string
-	help   bool
-	debug  bool
+	config      string
+	help        bool
+	debug       bool
+	keylogForce bool
 )
 
 func init() {
 	flag.BoolVar(&help, "h", false, "this help")
 	flag.BoolVar(&debug, "debug", false, "debug mode")
 	flag.StringVar(&config, "config", "config.yaml", "configure file.")
+	flag.BoolVar(&keylogForce, "keylog-force", false, "allow key_log_file without debug mode.")
 }
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "certgen" {
+		err := certgenMain(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "maintenance" {
+		err := maintenanceMain(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "ocsp" {
+		err := ocspMain(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
+
 	flag.Parse()
 	if help {
 		flag.Usage()
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 维护模式，开启后不再转发到监听的集群
+const (
+	MAINTENANCE_BANNER   = "banner"
+	MAINTENANCE_FALLBACK = "fallback"
+	MAINTENANCE_QUEUE    = "queue"
+)
+
+const (
+	maintenanceWatchInterval = 2 * time.Second
+	maintenanceQueueTimeout  = 60 * time.Second
+	maintenanceWriteTimeout  = 10 * time.Second
+)
+
+// banner 模式发送 banner 或 banner_file 的内容后关闭连接；
+// fallback 模式转发到 cluster 指定的集群；
+// queue 模式挂起连接直到维护结束，超过 queue_timeout 秒或 queue_size 个连接时
+// 发送banner(如有)后关闭。
+type MaintenanceConfig struct {
+	Mode         string `yaml:"mode"`
+	Banner       string `yaml:"banner"`
+	BannerFile   string `yaml:"banner_file"`
+	Cluster      string `yaml:"cluster"`
+	QueueTimeout int    `yaml:"queue_timeout"`
+	QueueSize    int    `yaml:"queue_size"`
+}
+
+type Maintenance struct {
+	sync.Mutex
+
+	address    string
+	mode       string
+	banner     []byte
+	bannerFile string
+	fallback   *TcpProxy
+	timeout    time.Duration
+	size       int64
+	queued     int64
+	active     bool
+	release    chan struct{}
+}
+
+var maintenanceLock sync.Mutex
+var maintenanceList = make(map[string]*Maintenance)
+
+func maintenanceBuild(v ListernerConfig) *Maintenance {
+	cfg := v.Maintenance
+	m := &Maintenance{address: v.Address, mode: cfg.Mode, banner: []byte(cfg.Banner),
+		bannerFile: cfg.BannerFile, size: int64(cfg.QueueSize), release: make(chan struct{})}
+
+	switch cfg.Mode {
+	case MAINTENANCE_BANNER:
+		if cfg.Banner == "" && cfg.BannerFile == "" {
+			log.Fatalf("listener %s maintenance banner needs banner or banner_file.", v.Address)
+		}
+	case MAINTENANCE_FALLBACK:
+		if cfg.Cluster == "" {
+			log.Fatalf("listener %s maintenance fallback needs cluster.", v.Address)
+		}
+		// 代理模式的客户端发送的是代理协议，无法原样转发到其他集群
+		if v.Mode == MODE_SOCKS5 || v.Mode == MODE_HTTP_CONNECT {
+			log.Fatalf("listener %s mode %s does not support maintenance fallback.", v.Address, v.Mode)
+		}
+		m.fallback = clusterRoute(v, cfg.Cluster)
+	case MAINTENANCE_QUEUE:
+		m.timeout = maintenanceQueueTimeout
+		if cfg.QueueTimeout > 0 {
+			m.timeout = time.Duration(cfg.QueueTimeout) * time.Second
+		}
+	default:
+		log.Fatalf("listener %s unknown maintenance mode %s.", v.Address, cfg.Mode)
+	}
+
+	if cfg.BannerFile != "" {
+		body, err := os.ReadFile(cfg.BannerFile)
+		if err != nil {
+			log.Fatalf("listener %s maintenance %s.", v.Address, err.Error())
+		}
+		m.banner = body
+	}
+
+	maintenanceLock.Lock()
+	maintenanceList[v.Address] = m
+	maintenanceLock.Unlock()
+
+	return m
+}
+
+func (m *Maintenance) Active() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.active
+}
+
+func (m *Maintenance) SetActive(active bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.active == active {
+		return
+	}
+	m.active = active
+
+	if active {
+		// 每次开启时重新读取，修改banner文件后无需重启
+		if m.bannerFile != "" {
+			body, err := os.ReadFile(m.bannerFile)
+			if err != nil {
+				log.Printf("listener %s maintenance %s, keep last banner.", m.address, err.Error())
+			} else {
+				m.banner = body
+			}
+		}
+		m.release = make(chan struct{})
+		log.Printf("listener %s maintenance on, mode %s.", m.address, m.mode)
+	} else {
+		// 放行排队中的连接
+		close(m.release)
+		log.Printf("listener %s maintenance off.", m.address)
+	}
+}
+
+// 维护中的连接处理，排队的连接在维护结束后返回true继续正常转发
+func (m *Maintenance) Serve(t *TcpProxy, localconn net.Conn) bool {
+	m.Lock()
+	banner, release := m.banner, m.release
+	m.Unlock()
+
+	switch m.mode {
+	case MAINTENANCE_FALLBACK:
+		if t.ListenTls != nil {
+			localconn = tls.Server(localconn, t.ListenTls)
+		}
+		remoteconn, endpoint := m.fallback.dial(m.fallback.Remote.AffinityKey(localconn))
+		if remoteconn == nil {
+			localconn.Close()
+			return false
+		}
+		defer m.fallback.Remote.Release(endpoint)
+
+		log.Printf("%s maintenance fallback to %s", localconn.RemoteAddr().String(), endpoint.Address)
+		tcpProxyProcess(localconn, remoteconn, nil)
+		return false
+
+	case MAINTENANCE_QUEUE:
+		if atomic.AddInt64(&m.queued, 1) <= m.size || m.size <= 0 {
+			timer := time.NewTimer(m.timeout)
+			select {
+			case <-release:
+				timer.Stop()
+				atomic.AddInt64(&m.queued, -1)
+				return true
+			case <-timer.C:
+				log.Printf("%s maintenance queue timeout", localconn.RemoteAddr().String())
+			}
+		} else {
+			log.Printf("%s maintenance queue full", localconn.RemoteAddr().String())
+		}
+		atomic.AddInt64(&m.queued, -1)
+	}
+
+	if len(banner) > 0 {
+		if t.ListenTls != nil {
+			localconn = tls.Server(localconn, t.ListenTls)
+		}
+		localconn.SetWriteDeadline(time.Now().Add(maintenanceWriteTimeout))
+		_, err := localconn.Write(banner)
+		if err != nil {
+			log.Printf("%s maintenance banner %s", localconn.RemoteAddr().String(), err.Error())
+		}
+	}
+	localconn.Close()
+	return false
+}
+
+func (m *Maintenance) Queued() int64 {
+	return atomic.LoadInt64(&m.queued)
+}
+
+// 维护状态文件默认和配置文件放在同一目录
+func maintenanceFile() string {
+	if globalconfig.MaintenanceFile != "" {
+		return globalconfig.MaintenanceFile
+	}
+	return filepath.Join(filepath.Dir(config), "maintenance.state")
+}
+
+// 状态文件每行一个处于维护中的监听地址，#之后为注释
+func maintenanceParse(body []byte) map[string]bool {
+	output := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			output[line] = true
+		}
+	}
+	return output
+}
+
+type MaintenanceWatch struct {
+	filename string
+	modtime  time.Time
+	body     []byte
+	loaded   bool
+}
+
+// 定时检查状态文件，在运行中切换维护模式，重启后保持
+func MaintenanceWatchStart() {
+	maintenanceLock.Lock()
+	count := len(maintenanceList)
+	maintenanceLock.Unlock()
+	if count == 0 {
+		return
+	}
+
+	w := &MaintenanceWatch{filename: maintenanceFile()}
+	log.Printf("maintenance state file %s", w.filename)
+	w.refresh()
+
+	go func() {
+		for {
+			time.Sleep(maintenanceWatchInterval)
+			w.refresh()
+		}
+	}()
+}
+
+func (w *MaintenanceWatch) refresh() {
+	var body []byte
+
+	info, err := os.Stat(w.filename)
+	if err == nil {
+		if w.loaded && info.ModTime().Equal(w.modtime) {
+			return
+		}
+		body, err = os.ReadFile(w.filename)
+		if err != nil {
+			log.Printf("maintenance state file %s", err.Error())
+			return
+		}
+		w.modtime = info.ModTime()
+	} else if !os.IsNotExist(err) {
+		log.Printf("maintenance state file %s", err.Error())
+		return
+	}
+
+	if w.loaded && bytes.Equal(body, w.body) {
+		return
+	}
+	w.body = body
+	w.loaded = true
+
+	state := maintenanceParse(body)
+
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	for address := range state {
+		if _, ok := maintenanceList[address]; !ok {
+			log.Printf("maintenance state file: listener %s has no maintenance config.", address)
+		}
+	}
+	for address, m := range maintenanceList {
+		m.SetActive(state[address])
+	}
+}
+
+func maintenanceDisplay() {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	for _, m := range maintenanceList {
+		if !m.Active() {
+			continue
+		}
+		if m.mode == MAINTENANCE_QUEUE {
+			log.Printf("listen %s maintenance %s (%d queued)\n", m.address, m.mode, m.Queued())
+		} else {
+			log.Printf("listen %s maintenance %s\n", m.address, m.mode)
+		}
+	}
+}
+
+// engine maintenance 子命令：修改状态文件，运行中的engine会在几秒内生效
+func maintenanceMain(args []string) error {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	fs.StringVar(&config, "config", "config.yaml", "configure file.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: engine maintenance [-config file] on|off|list [listener address ...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	err := LoadConfig(config)
+	if err != nil {
+		return err
+	}
+
+	filename := maintenanceFile()
+	body, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	state := maintenanceParse(body)
+
+	command := fs.Arg(0)
+	switch command {
+	case "list":
+		for _, v := range listenerGetAll() {
+			if v.Maintenance == nil {
+				continue
+			}
+			status := "off"
+			if state[v.Address] {
+				status = "on"
+			}
+			fmt.Printf("%s %s %s\n", v.Address, v.Maintenance.Mode, status)
+		}
+		return nil
+	case "on", "off":
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %s", command)
+	}
+
+	if fs.NArg() < 2 {
+		return fmt.Errorf("%s needs listener addresses", command)
+	}
+	for _, address := range fs.Args()[1:] {
+		found := false
+		for _, v := range listenerGetAll() {
+			if v.Address == address && v.Maintenance != nil {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("listener %s has no maintenance config", address)
+		}
+		state[address] = command == "on"
+	}
+
+	var output []string
+	for address, on := range state {
+		if on {
+			output = append(output, address)
+		}
+	}
+	sort.Strings(output)
+
+	content := "# listeners in maintenance, written by engine maintenance\n"
+	for _, v := range output {
+		content += v + "\n"
+	}
+	err = maintenanceWrite(filename, []byte(content))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "maintenance %s %s, state file %s\n", command, strings.Join(fs.Args()[1:], " "), filename)
+	return nil
+}
+
+// 先写同目录下的临时文件再改名，engine不会读到写了一半的状态文件
+func maintenanceWrite(filename string, body []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+
+	_, err = file.Write(body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 以Prometheus文本格式输出流量、接入计数、后端会话和健康状态、维护状态和证书剩余天数
+func MetricsStart(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	log.Printf("metrics listen on %s", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Fatalf("metrics listen %s failed, %s.", address, err.Error())
+	}
+}
+
+// 标签值按Prometheus文本格式只转义反斜杠、双引号和换行，其余字符原样输出
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsLabel(value string) string {
+	return `"` + metricsEscaper.Replace(value) + `"`
+}
+
+// 后端的labels作为Prometheus标签输出，名称须符合标签命名规则且不能与内置标签重名
+var metricsLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func metricsLabelCheck(name string) bool {
+	return metricsLabelName.MatchString(name) && !strings.HasPrefix(name, "__") &&
+		name != "cluster" && name != "endpoint"
+}
+
+func metricsEndpoint(cluster string, e *Endpoint) string {
+	output := "cluster=" + metricsLabel(cluster) + ",endpoint=" + metricsLabel(e.Address)
+	names := make([]string, 0, len(e.Labels))
+	for name := range e.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output += "," + name + "=" + metricsLabel(e.Labels[name])
+	}
+	return output
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP tcpproxy_up_bytes_total Bytes sent to the backends.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_up_bytes_total counter\n")
+	fmt.Fprintf(w, "tcpproxy_up_bytes_total %d\n", atomic.LoadUint64(&gtotalUpSize))
+	fmt.Fprintf(w, "# HELP tcpproxy_down_bytes_total Bytes sent to the clients.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_down_bytes_total counter\n")
+	fmt.Fprintf(w, "tcpproxy_down_bytes_total %d\n", atomic.LoadUint64(&gtotalDownSize))
+
+	fmt.Fprintf(w, "# HELP tcpproxy_listener_accepts_total Connections accepted by the listener.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_listener_accepts_total counter\n")
+	listenerStatLock.Lock()
+	for _, s := range listenerStats {
+		fmt.Fprintf(w, "tcpproxy_listener_accepts_total{listener=%s} %d\n",
+			metricsLabel(s.Address), atomic.LoadUint64(&s.accepts))
+	}
+	listenerStatLock.Unlock()
+
+	fmt.Fprintf(w, "# HELP tcpproxy_listener_maintenance Whether the listener is in maintenance mode.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_listener_maintenance gauge\n")
+	maintenanceLock.Lock()
+	for address, m := range maintenanceList {
+		active := 0
+		if m.Active() {
+			active = 1
+		}
+		fmt.Fprintf(w, "tcpproxy_listener_maintenance{listener=%s,mode=%s} %d\n",
+			metricsLabel(address), metricsLabel(m.mode), active)
+	}
+	maintenanceLock.Unlock()
+
+	var sessions, up []string
+	now := time.Now()
+	balancerLock.Lock()
+	for _, b := range balancers {
+		b.Lock()
+		for _, e := range b.endpoints() {
+			labels := metricsEndpoint(b.Name, e)
+			healthy := 0
+			if e.Healthy(now) {
+				healthy = 1
+			}
+			sessions = append(sessions, fmt.Sprintf("tcpproxy_endpoint_sessions{%s} %d\n", labels, atomic.LoadInt64(&e.sessions)))
+			up = append(up, fmt.Sprintf("tcpproxy_endpoint_up{%s} %d\n", labels, healthy))
+		}
+		b.Unlock()
+	}
+	balancerLock.Unlock()
+
+	fmt.Fprintf(w, "# HELP tcpproxy_endpoint_sessions Sessions open to the backend endpoint.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_endpoint_sessions gauge\n")
+	fmt.Fprint(w, strings.Join(sessions, ""))
+	fmt.Fprintf(w, "# HELP tcpproxy_endpoint_up Whether the backend endpoint is accepting new sessions.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_endpoint_up gauge\n")
+	fmt.Fprint(w, strings.Join(up, ""))
+
+	certs := certExpiry.List()
+	fmt.Fprintf(w, "# HELP tcpproxy_cert_expiry_days Whole days until the certificate chain expires.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_cert_expiry_days gauge\n")
+	for _, v := range certs {
+		fmt.Fprintf(w, "tcpproxy_cert_expiry_days{name=%s,subject=%s} %d\n",
+			metricsLabel(v.Name), metricsLabel(v.Subject), v.Days())
+	}
+	fmt.Fprintf(w, "# HELP tcpproxy_cert_not_after_seconds Expiry of the certificate chain as a unix timestamp.\n")
+	fmt.Fprintf(w, "# TYPE tcpproxy_cert_not_after_seconds gauge\n")
+	for _, v := range certs {
+		fmt.Fprintf(w, "tcpproxy_cert_not_after_seconds{name=%s,subject=%s} %d\n",
+			metricsLabel(v.Name), metricsLabel(v.Subject), v.NotAfter.Unix())
+	}
+}
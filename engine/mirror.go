@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/linimbus/tcpproxy-windows/forward"
+)
+
+// 影子集群会话的缓存队列长度，队列满时停止镜像，避免拖慢主会话。
+const mirrorQueueSize = 64
+
+type TcpMirror struct {
+	Cluster  string
+	Percent  int
+	MaxBytes int
+	Tls      *tls.Config
+	Remote   *Balancer
+}
+
+type mirrorSession struct {
+	queue chan []byte
+	limit int
+	sent  int
+	stop  bool
+}
+
+func NewTcpMirror(cfg *MirrorConfig, remote *Balancer, remotetls *tls.Config) *TcpMirror {
+	percent := cfg.Percent
+	if percent <= 0 || percent > 100 {
+		percent = 100
+	}
+	return &TcpMirror{Cluster: cfg.Cluster, Percent: percent, MaxBytes: cfg.MaxBytes,
+		Tls: remotetls, Remote: remote}
+}
+
+// 按采样比例决定是否为新会话开启镜像，未命中返回nil。
+func (m *TcpMirror) Session() *mirrorSession {
+	if m == nil {
+		return nil
+	}
+	if m.Percent < 100 && rand.Intn(100) >= m.Percent {
+		return nil
+	}
+
+	endpoints := m.Remote.Next("")
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	s := &mirrorSession{queue: make(chan []byte, mirrorQueueSize), limit: m.MaxBytes}
+	go s.run(m.Remote, endpoints, m.Tls)
+	return s
+}
+
+// 与主会话一样按负载均衡顺序连接，连接前占用连接数，失败或会话结束时释放
+func (s *mirrorSession) run(remote *Balancer, endpoints []*Endpoint, def *tls.Config) {
+	var conn net.Conn
+	var endpoint *Endpoint
+	for _, v := range endpoints {
+		if !remote.Acquire(v) {
+			continue
+		}
+		remoteconn, err := remote.Dial(v, 5*time.Second)
+		if err != nil {
+			log.Printf("mirror connect to %s failed, %s", v.Address, err.Error())
+			remote.Release(v)
+			remote.Down(v)
+			continue
+		}
+		conn, endpoint = remoteconn, v
+		break
+	}
+	if conn == nil {
+		for range s.queue {
+		}
+		return
+	}
+	defer remote.Release(endpoint)
+
+	if remotetls := endpoint.TlsConfig(def); remotetls != nil {
+		conn = tls.Client(conn, remotetls)
+	}
+	defer conn.Close()
+
+	// 丢弃影子集群的应答
+	go io.Copy(ioutil.Discard, conn)
+
+	broken := false
+	for buf := range s.queue {
+		if broken {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if forward.WriteFull(conn, buf) != nil {
+			broken = true
+		}
+	}
+}
+
+// 复制一份上行数据发往影子集群，不阻塞主会话。
+func (s *mirrorSession) Write(buf []byte) {
+	if s == nil || s.stop {
+		return
+	}
+	if s.limit > 0 && s.sent+len(buf) > s.limit {
+		buf = buf[:s.limit-s.sent]
+		s.stop = true
+	}
+	if len(buf) > 0 {
+		body := make([]byte, len(buf))
+		copy(body, buf)
+		select {
+		case s.queue <- body:
+			s.sent += len(body)
+		default:
+			s.stop = true
+		}
+	}
+	if s.stop {
+		close(s.queue)
+	}
+}
+
+func (s *mirrorSession) Close() {
+	if s == nil || s.stop {
+		return
+	}
+	s.stop = true
+	close(s.queue)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/linimbus/tcpproxy-windows/keystore"
+)
+
+// engine ocsp 子命令：用certgen生成的CA签名的本地OCSP响应器，
+// 吊销列表中的证书回答revoked，其余回答good，用于测试OCSP装订。
+func ocspMain(args []string) error {
+	var dir, name, crlfile, listen string
+	var validity time.Duration
+
+	fs := flag.NewFlagSet("ocsp", flag.ExitOnError)
+	fs.StringVar(&dir, "dir", "certs", "certificate directory of certgen.")
+	fs.StringVar(&name, "ca", CERT_CA, "name of the ca in the directory.")
+	fs.StringVar(&crlfile, "crl", "", "crl with the revoked certificates. default <ca>.crl in the directory.")
+	fs.StringVar(&listen, "listen", "127.0.0.1:8888", "listen address.")
+	fs.DurationVar(&validity, "validity", time.Hour, "validity of the responses.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: engine ocsp [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+	if err != nil {
+		return fmt.Errorf("load ca %s failed, %s", name, err.Error())
+	}
+	issuer, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	if crlfile == "" {
+		crlfile = filepath.Join(dir, name+".crl")
+		if _, err := os.Stat(crlfile); err != nil {
+			crlfile = ""
+		}
+	}
+
+	var crl *keystore.CRLSet
+	if crlfile != "" {
+		crl = keystore.NewCRLSet([]string{crlfile}, []*x509.Certificate{issuer})
+		_, err = crl.Refresh()
+		if err != nil {
+			return err
+		}
+	}
+
+	responder := &keystore.OCSPResponder{
+		Issuer:   issuer,
+		Signer:   pair.PrivateKey.(crypto.Signer),
+		Validity: validity,
+		Revoked: func(serial *big.Int) (time.Time, bool) {
+			if crl == nil {
+				return time.Time{}, false
+			}
+			// 每次请求重新读取，certgen -type crl 更新后立即生效
+			_, err := crl.Refresh()
+			if err != nil {
+				log.Println(err.Error())
+			}
+			return crl.Lookup(issuer.RawSubject, serial)
+		},
+	}
+
+	log.Printf("ocsp responder for %s listen on %s, crl %s", issuer.Subject.CommonName, listen, crlfile)
+	return http.ListenAndServe(listen, responder)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 代理模式下目标地址的访问控制。allow/deny 的每一项可以是CIDR、IP、
+// 域名或 *.域名 通配；ports 为允许的端口或端口范围，为空表示不限制。
+// 本机、内网和云主机元数据地址始终禁止，只能通过 allow 中覆盖该地址的CIDR或IP放开。
+type PolicyConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	Ports []string `yaml:"ports"`
+}
+
+// 默认禁止访问本机和内网地址，避免被用作SSRF跳板
+var reservedDeny = []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "localhost", "*.localhost",
+	"metadata.google.internal"}
+
+type policyRule struct {
+	cidr *net.IPNet
+	host string
+	wild bool
+}
+
+type policyPort struct {
+	low  int
+	high int
+}
+
+type Policy struct {
+	reserved []policyRule
+	allow    []policyRule
+	deny     []policyRule
+	ports    []policyPort
+}
+
+func NewPolicy(cfg *PolicyConfig) (*Policy, error) {
+	if cfg == nil {
+		cfg = &PolicyConfig{}
+	}
+
+	var err error
+	p := new(Policy)
+	p.reserved, err = policyRules(reservedDeny)
+	if err != nil {
+		return nil, err
+	}
+	p.allow, err = policyRules(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	p.deny, err = policyRules(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range cfg.Ports {
+		low, high := v, v
+		if idx := strings.Index(v, "-"); idx > 0 {
+			low, high = v[:idx], v[idx+1:]
+		}
+		var port policyPort
+		port.low, err = strconv.Atoi(strings.TrimSpace(low))
+		if err != nil {
+			return nil, fmt.Errorf("policy invalid port %s", v)
+		}
+		port.high, err = strconv.Atoi(strings.TrimSpace(high))
+		if err != nil || port.high < port.low {
+			return nil, fmt.Errorf("policy invalid port %s", v)
+		}
+		p.ports = append(p.ports, port)
+	}
+	return p, nil
+}
+
+func policyRules(list []string) ([]policyRule, error) {
+	var output []policyRule
+	for _, v := range list {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if strings.Contains(v, "/") {
+			_, cidr, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, fmt.Errorf("policy invalid cidr %s", v)
+			}
+			output = append(output, policyRule{cidr: cidr})
+			continue
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			output = append(output, policyRule{cidr: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+			continue
+		}
+		if strings.HasPrefix(v, "*.") {
+			output = append(output, policyRule{host: v[1:], wild: true})
+			continue
+		}
+		output = append(output, policyRule{host: strings.TrimSuffix(v, ".")})
+	}
+	return output, nil
+}
+
+func (r *policyRule) matchHost(host string) bool {
+	if r.host == "" || host == "" {
+		return false
+	}
+	if r.wild {
+		return strings.HasSuffix(host, r.host)
+	}
+	return host == r.host
+}
+
+func (r *policyRule) matchIP(ip net.IP) bool {
+	return r.cidr != nil && r.cidr.Contains(ip)
+}
+
+func (p *Policy) allowHost(host string) bool {
+	for _, rule := range p.allow {
+		if rule.matchHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowIP(ip net.IP) bool {
+	for _, rule := range p.allow {
+		if rule.matchIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析目标地址并检查策略，返回实际要连接的地址。
+// 连接时使用检查过的IP，避免二次解析被DNS重绑定绕过。
+func (p *Policy) Resolve(host string, port int) (string, error) {
+	if len(p.ports) > 0 {
+		allowed := false
+		for _, v := range p.ports {
+			if port >= v.low && port <= v.high {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("policy deny port %d", port)
+		}
+	}
+
+	var name string
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		name = strings.ToLower(strings.TrimSuffix(host, "."))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		for _, v := range addrs {
+			ips = append(ips, v.IP)
+		}
+		if len(ips) == 0 {
+			return "", &net.DNSError{Err: "no address", Name: host, IsNotFound: true}
+		}
+	}
+
+	for _, rule := range p.deny {
+		if rule.matchHost(name) {
+			return "", fmt.Errorf("policy deny %s", host)
+		}
+		for _, ip := range ips {
+			if rule.matchIP(ip) {
+				return "", fmt.Errorf("policy deny %s(%s)", host, ip.String())
+			}
+		}
+	}
+
+	// 保留地址段不能通过域名放开，避免被解析到内网地址的域名绕过
+	for _, rule := range p.reserved {
+		if rule.matchHost(name) && !p.allowHost(name) {
+			return "", fmt.Errorf("policy deny %s", host)
+		}
+		for _, ip := range ips {
+			if rule.matchIP(ip) && !p.allowIP(ip) {
+				return "", fmt.Errorf("policy deny %s(%s)", host, ip.String())
+			}
+		}
+	}
+
+	if len(p.allow) > 0 && !p.allowHost(name) {
+		for _, ip := range ips {
+			if !p.allowIP(ip) {
+				return "", fmt.Errorf("policy not allow %s(%s)", host, ip.String())
+			}
+		}
+	}
+
+	return net.JoinHostPort(ips[0].String(), strconv.Itoa(port)), nil
+}
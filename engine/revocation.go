@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/linimbus/tcpproxy-windows/keystore"
+)
+
+const (
+	crlDefaultRefresh  = time.Hour
+	crlMinRefresh      = time.Minute
+	ocspDefaultRefresh = time.Hour
+	ocspRetry          = time.Minute
+	ocspTimeout        = 10 * time.Second
+)
+
+// 同一个tls配置被多个监听或集群引用时共用吊销列表和OCSP响应
+var revocationLock sync.Mutex
+var crlSets = make(map[string]*keystore.CRLSet)
+var ocspStaples = make(map[string]*OcspStaple)
+
+func TlsCrlGet(cfg *TlsConfig) *keystore.CRLSet {
+	if len(cfg.CRL) == 0 {
+		return nil
+	}
+
+	revocationLock.Lock()
+	defer revocationLock.Unlock()
+
+	if crl, ok := crlSets[cfg.Name]; ok {
+		return crl
+	}
+
+	if cfg.CA == "" {
+		log.Fatalf("tls %s crl needs ca to check the crl signature.", cfg.Name)
+	}
+	issuers, err := keystore.LoadCerts(cfg.CA)
+	if err != nil {
+		log.Fatalf("tls %s %s.", cfg.Name, err.Error())
+	}
+
+	crl := keystore.NewCRLSet(cfg.CRL, issuers)
+	next, err := crl.Refresh()
+	if err != nil {
+		log.Fatalf("tls %s %s.", cfg.Name, err.Error())
+	}
+	crlSets[cfg.Name] = crl
+
+	interval := time.Duration(cfg.CRLRefresh) * time.Second
+	if interval <= 0 {
+		interval = crlDefaultRefresh
+	}
+	go crlRun(cfg.Name, crl, interval, next)
+
+	return crl
+}
+
+// 按固定间隔刷新，吊销列表的下次更新时间更早时提前刷新
+func crlRun(name string, crl *keystore.CRLSet, interval time.Duration, next time.Time) {
+	for {
+		wait := interval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		if wait < crlMinRefresh {
+			wait = crlMinRefresh
+		}
+		time.Sleep(wait)
+
+		var err error
+		next, err = crl.Refresh()
+		if err != nil {
+			log.Printf("tls %s %s.", name, err.Error())
+		}
+	}
+}
+
+// 依次执行指纹和吊销检查，握手是延迟进行的，在这里记录拒绝原因
+func tlsVerify(cfg *TlsConfig) func([][]byte, [][]*x509.Certificate) error {
+	var verify []func([][]byte, [][]*x509.Certificate) error
+	if pins := tlsPins(cfg); pins != nil {
+		verify = append(verify, pins)
+	}
+	if crl := TlsCrlGet(cfg); crl != nil {
+		verify = append(verify, crl.VerifyPeerCertificate)
+	}
+	if len(verify) == 0 {
+		return nil
+	}
+	name := cfg.Name
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, fn := range verify {
+			err := fn(rawCerts, verifiedChains)
+			if err != nil {
+				log.Printf("tls %s peer rejected, %s.", name, err.Error())
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// 服务端证书的OCSP装订，在响应过期之前重新获取
+type OcspStaple struct {
+	sync.RWMutex
+
+	name     string
+	server   string
+	leaf     *x509.Certificate
+	issuer   *x509.Certificate
+	interval time.Duration
+	cert     *tls.Certificate
+	expire   time.Time
+}
+
+func TlsStapleGet(cfg *TlsConfig, cert tls.Certificate) *OcspStaple {
+	revocationLock.Lock()
+	defer revocationLock.Unlock()
+
+	if staple, ok := ocspStaples[cfg.Name]; ok {
+		return staple
+	}
+
+	issuer := ocspIssuer(cfg, cert)
+	if issuer == nil {
+		log.Fatalf("tls %s ocsp_staple needs the issuer certificate in the chain or ca.", cfg.Name)
+	}
+
+	server := cfg.OcspResponder
+	if server == "" && len(cert.Leaf.OCSPServer) > 0 {
+		server = cert.Leaf.OCSPServer[0]
+	}
+	if server == "" {
+		log.Fatalf("tls %s certificate has no ocsp server, set ocsp_responder.", cfg.Name)
+	}
+
+	staple := &OcspStaple{name: cfg.Name, server: server, leaf: cert.Leaf, issuer: issuer, cert: &cert}
+	staple.interval = time.Duration(cfg.OcspRefresh) * time.Second
+	if staple.interval <= 0 {
+		staple.interval = ocspDefaultRefresh
+	}
+	ocspStaples[cfg.Name] = staple
+
+	// 首次获取在后台进行，失败不影响启动，先不带装订提供服务
+	go staple.run()
+
+	return staple
+}
+
+func ocspIssuer(cfg *TlsConfig, cert tls.Certificate) *x509.Certificate {
+	if len(cert.Certificate) > 1 {
+		issuer, err := x509.ParseCertificate(cert.Certificate[1])
+		if err == nil && cert.Leaf.CheckSignatureFrom(issuer) == nil {
+			return issuer
+		}
+	}
+	if cfg.CA == "" {
+		return nil
+	}
+	certs, err := keystore.LoadCerts(cfg.CA)
+	if err != nil {
+		log.Fatalf("tls %s %s.", cfg.Name, err.Error())
+	}
+	for _, v := range certs {
+		if bytes.Equal(v.RawSubject, cert.Leaf.RawIssuer) && cert.Leaf.CheckSignatureFrom(v) == nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *OcspStaple) run() {
+	for {
+		time.Sleep(s.refresh())
+	}
+}
+
+// 获取一次OCSP响应，返回下次刷新前的等待时间
+func (s *OcspStaple) refresh() time.Duration {
+	resp, err := keystore.FetchOCSP(s.server, s.leaf, s.issuer, ocspTimeout)
+	if err != nil {
+		log.Printf("tls %s ocsp %s %s.", s.name, s.server, err.Error())
+		s.dropExpired()
+		return ocspRetry
+	}
+
+	switch resp.Status {
+	case keystore.OCSPUnknown:
+		log.Printf("tls %s ocsp %s does not know the certificate.", s.name, s.server)
+		s.dropExpired()
+		return ocspRetry
+	case keystore.OCSPRevoked:
+		log.Printf("WARNING: tls %s certificate revoked at %s.", s.name, resp.RevokedAt.Format(time.DateTime))
+	}
+
+	cert := *s.cert
+	cert.OCSPStaple = resp.Raw
+
+	s.Lock()
+	s.cert = &cert
+	s.expire = resp.NextUpdate
+	s.Unlock()
+
+	if debug {
+		log.Printf("tls %s ocsp staple updated, next update %s.", s.name, resp.NextUpdate.Format(time.DateTime))
+	}
+
+	// 在有效期过半时刷新，不超过 ocsp_refresh
+	wait := s.interval
+	if !resp.NextUpdate.IsZero() {
+		if half := time.Until(resp.NextUpdate) / 2; half < wait {
+			wait = half
+		}
+	}
+	if wait < ocspRetry {
+		wait = ocspRetry
+	}
+	return wait
+}
+
+// 获取失败时保留仍在有效期内的响应，过期后不再装订
+func (s *OcspStaple) dropExpired() {
+	s.Lock()
+	defer s.Unlock()
+	if s.cert.OCSPStaple == nil || s.expire.IsZero() || time.Now().Before(s.expire) {
+		return
+	}
+	cert := *s.cert
+	cert.OCSPStaple = nil
+	s.cert = &cert
+	log.Printf("tls %s ocsp staple expired.", s.name)
+}
+
+func (s *OcspStaple) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.cert, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"regexp/syntax"
+	"time"
+)
+
+const (
+	SNIFF_TLS    = "tls"
+	SNIFF_HTTP   = "http"
+	SNIFF_SSH    = "ssh"
+	SNIFF_PROXY  = "proxy"
+	SNIFF_PREFIX = "prefix"
+	SNIFF_REGEX  = "regex"
+)
+
+// 嗅探最多读取的字节数
+const sniffPeekMax = 1024
+
+type SniffRuleConfig struct {
+	Protocol string `yaml:"protocol"`
+	Match    string `yaml:"match"`
+	Cluster  string `yaml:"cluster"`
+}
+
+type SniffConfig struct {
+	Timeout int               `yaml:"timeout"`
+	Rules   []SniffRuleConfig `yaml:"rules"`
+}
+
+var sniffMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "), []byte("PRI "),
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type sniffRule struct {
+	protocol string
+	prefix   [][]byte
+	regex    *regexp.Regexp
+	anchor   []byte
+	proxy    *TcpProxy
+}
+
+// 前缀匹配，数据不足以判断时返回more
+func matchPrefix(buf []byte, prefix [][]byte) (matched bool, more bool) {
+	for _, v := range prefix {
+		if len(buf) >= len(v) {
+			if bytes.HasPrefix(buf, v) {
+				return true, false
+			}
+		} else if bytes.HasPrefix(v, buf) {
+			more = true
+		}
+	}
+	return false, more
+}
+
+func (r *sniffRule) match(buf []byte) (bool, bool) {
+	if r.protocol == SNIFF_TLS {
+		// TLS记录头: handshake(0x16) 版本 0x03 0x0X
+		if len(buf) < 3 {
+			return false, len(buf) == 0 || (buf[0] == 0x16 && (len(buf) < 2 || buf[1] == 0x03))
+		}
+		return buf[0] == 0x16 && buf[1] == 0x03 && buf[2] <= 0x04, false
+	}
+	// 以固定前缀开头的正则，数据与前缀不符时不会再匹配；其他情况无法判断部分数据，继续等待
+	if r.regex != nil {
+		if r.regex.Match(buf) {
+			return true, false
+		}
+		size := min(len(buf), len(r.anchor))
+		if !bytes.Equal(buf[:size], r.anchor[:size]) {
+			return false, false
+		}
+		return false, true
+	}
+	return matchPrefix(buf, r.prefix)
+}
+
+func newSniffRule(cfg SniffRuleConfig) (*sniffRule, error) {
+	r := &sniffRule{protocol: cfg.Protocol}
+	switch cfg.Protocol {
+	case SNIFF_TLS:
+	case SNIFF_HTTP:
+		r.prefix = sniffMethods
+	case SNIFF_SSH:
+		r.prefix = [][]byte{[]byte("SSH-")}
+	case SNIFF_PROXY:
+		r.prefix = [][]byte{[]byte("PROXY "), proxyV2Signature}
+	case SNIFF_PREFIX:
+		if cfg.Match == "" {
+			return nil, fmt.Errorf("sniff prefix rule has no match")
+		}
+		r.prefix = [][]byte{[]byte(cfg.Match)}
+	case SNIFF_REGEX:
+		regex, err := regexp.Compile(cfg.Match)
+		if err != nil {
+			return nil, fmt.Errorf("sniff regex %s, %s", cfg.Match, err.Error())
+		}
+		r.regex = regex
+		if regexAnchored(cfg.Match) {
+			prefix, _ := regex.LiteralPrefix()
+			r.anchor = []byte(prefix)
+		}
+	default:
+		return nil, fmt.Errorf("sniff unknown protocol %s", cfg.Protocol)
+	}
+	return r, nil
+}
+
+// 正则是否只能从数据开头匹配
+func regexAnchored(expr string) bool {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	for (re.Op == syntax.OpConcat || re.Op == syntax.OpCapture) && len(re.Sub) > 0 {
+		re = re.Sub[0]
+	}
+	return re.Op == syntax.OpBeginText
+}
+
+// 同一端口上按首包内容区分协议，嗅探读到的数据原样回放给后端
+type Sniffer struct {
+	timeout  time.Duration
+	rules    []*sniffRule
+	fallback *TcpProxy
+}
+
+func NewSniffer(cfg *SniffConfig, fallback *TcpProxy) (*Sniffer, error) {
+	s := &Sniffer{timeout: 2 * time.Second, fallback: fallback}
+	if cfg == nil {
+		return s, nil
+	}
+	if cfg.Timeout > 0 {
+		s.timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	for _, v := range cfg.Rules {
+		rule, err := newSniffRule(v)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// 按配置顺序匹配，前面的规则还需要更多数据时不能让后面的规则抢先命中。
+// 正则规则读完固定前缀后仍未匹配时无法判断还要多少数据，此时后面的规则确定命中
+// 就使用后面的规则，都不命中则继续等待，直到读满或超时
+func (s *Sniffer) classify(buf []byte, final bool) (*sniffRule, bool) {
+	pending := false
+	for _, rule := range s.rules {
+		matched, more := rule.match(buf)
+		if matched {
+			return rule, true
+		}
+		if more && !final {
+			if rule.regex == nil || len(buf) < len(rule.anchor) {
+				return nil, false
+			}
+			pending = true
+		}
+	}
+	return nil, !pending
+}
+
+func (s *Sniffer) peek(localconn net.Conn) ([]byte, *sniffRule, error) {
+	buf := make([]byte, 0, sniffPeekMax)
+
+	localconn.SetReadDeadline(time.Now().Add(s.timeout))
+	defer localconn.SetReadDeadline(time.Time{})
+
+	for {
+		cnt, err := localconn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+cnt]
+
+		// 服务端先发言的协议在超时后走默认集群
+		if err != nil && len(buf) == 0 {
+			if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+				return nil, nil, err
+			}
+		}
+
+		final := err != nil || len(buf) == cap(buf)
+		rule, done := s.classify(buf, final)
+		if done {
+			return buf, rule, nil
+		}
+	}
+}
+
+func (s *Sniffer) Serve(localconn net.Conn) {
+	buf, rule, err := s.peek(localconn)
+	if err != nil {
+		localconn.Close()
+		return
+	}
+
+	route, protocol := s.fallback, "fallback"
+	if rule != nil {
+		route, protocol = rule.proxy, rule.protocol
+	}
+	if route == nil {
+		log.Printf("%s sniff no route for %d bytes", localconn.RemoteAddr().String(), len(buf))
+		localconn.Close()
+		return
+	}
+
+	replay := &bufferedConn{Conn: localconn, reader: io.MultiReader(bytes.NewReader(buf), localconn)}
+
+	remoteconn, endpoint := route.dial(route.Remote.AffinityKey(localconn))
+	if remoteconn == nil {
+		localconn.Close()
+		return
+	}
+	defer route.Remote.Release(endpoint)
+
+	log.Printf("%s sniff %s to %s", localconn.RemoteAddr().String(), protocol, endpoint.Address)
+	tcpProxyProcess(replay, remoteconn, nil)
+}
+
+// 按集群名构建转发目标，后端TLS、key_log_file和监听的套接字选项与转发模式一致，
+// 供转发模式以及按协议或请求内容分流的监听模式使用
+func clusterRoute(v ListernerConfig, name string) *TcpProxy {
+	var remotetls *tls.Config
+
+	cluster := ClusterGet(name)
+	if cluster == nil {
+		log.Fatalf("not found %s cluster.", name)
+	}
+
+	if cluster.Empty() {
+		log.Fatalf("not found %s cluster endpoint.", name)
+	}
+
+	tls := TlsGet(cluster.TlsName)
+	if tls != nil {
+		remotetls = TlsClientConfig(tls, cluster.ServerName())
+	}
+
+	if cluster.KeyLogFile != "" {
+		if remotetls == nil {
+			log.Printf("cluster %s has no tls, key_log_file ignored.", cluster.Name)
+		} else {
+			remotetls.KeyLogWriter = TlsKeyLogWriter(cluster.KeyLogFile)
+		}
+	}
+
+	route := NewTcpProxy(v.Address, nil, BalancerGet(cluster), remotetls)
+	route.Options = v.SocketOptions
+	return route
+}
+
+func snifferBuild(v ListernerConfig) *Sniffer {
+	var fallback *TcpProxy
+	if v.Cluster != "" {
+		fallback = clusterRoute(v, v.Cluster)
+	}
+
+	sniffer, err := NewSniffer(v.Sniff, fallback)
+	if err != nil {
+		log.Fatalf("listener %s %s.", v.Address, err.Error())
+	}
+	for i, rule := range sniffer.rules {
+		rule.proxy = clusterRoute(v, v.Sniff.Rules[i].Cluster)
+	}
+	return sniffer
+}
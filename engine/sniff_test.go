@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestSniffRegexThenTls(t *testing.T) {
+	sniffer, err := NewSniffer(&SniffConfig{Rules: []SniffRuleConfig{
+		{Protocol: SNIFF_REGEX, Match: `^HELLO \d+`},
+		{Protocol: SNIFF_REGEX, Match: `token=[a-z]+`},
+		{Protocol: SNIFF_TLS},
+		{Protocol: SNIFF_HTTP},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchored, search, tls, http := sniffer.rules[0], sniffer.rules[1], sniffer.rules[2], sniffer.rules[3]
+
+	tests := []struct {
+		data string
+		rule *sniffRule
+		done bool
+	}{
+		// TLS记录头与正则的固定前缀不符，不用等到超时
+		{"\x16\x03\x01\x02\x00\x01", tls, true},
+		{"HEL", nil, false},
+		{"HELLO 42\r\n", anchored, true},
+		{"HELLO x", nil, false},
+		{"GET /?token=abc HTTP/1.1\r\n", search, true},
+		{"GET / HTTP/1.1\r\n", http, true},
+		{"GE", nil, false},
+		{"\x00\x01", nil, false},
+	}
+	for _, v := range tests {
+		rule, done := sniffer.classify([]byte(v.data), false)
+		if rule != v.rule || done != v.done {
+			t.Errorf("%q classified as %v %v", v.data, rule, done)
+		}
+	}
+
+	// 读满或超时后不再等待
+	if rule, done := sniffer.classify([]byte("HELLO x"), true); rule != nil || !done {
+		t.Errorf("final data classified as %v %v", rule, done)
+	}
+}
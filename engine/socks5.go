@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Connect   = 0x01
+	socks5Associate = 0x03
+
+	socks5Succeeded       = 0x00
+	socks5Failure         = 0x01
+	socks5NotAllowed      = 0x02
+	socks5HostUnreachable = 0x04
+	socks5CmdUnsupported  = 0x07
+)
+
+type ProxyUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type Socks5Config struct {
+	Users []ProxyUser `yaml:"users"`
+	Udp   bool        `yaml:"udp"`
+}
+
+// SOCKS5服务端，CONNECT和UDP ASSOCIATE请求的目标均需通过访问策略。
+type Socks5Server struct {
+	users  map[string]string
+	udp    bool
+	policy *Policy
+	dialer *Dialer
+	tls    *tls.Config
+}
+
+func NewSocks5Server(cfg *Socks5Config, policy *Policy, dialer *Dialer, remotetls *tls.Config) *Socks5Server {
+	s := &Socks5Server{users: make(map[string]string), policy: policy, dialer: dialer, tls: remotetls}
+	if cfg != nil {
+		s.udp = cfg.Udp
+		for _, v := range cfg.Users {
+			s.users[v.Username] = v.Password
+		}
+	}
+	return s
+}
+
+func socks5Reply(conn net.Conn, rep byte, addr net.Addr) error {
+	reply := []byte{0x05, rep, 0x00}
+	var ip net.IP
+	var port int
+	if tcpaddr, ok := addr.(*net.TCPAddr); ok {
+		ip, port = tcpaddr.IP, tcpaddr.Port
+	} else if udpaddr, ok := addr.(*net.UDPAddr); ok {
+		ip, port = udpaddr.IP, udpaddr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(append(reply, 0x01), ip4...)
+	} else if ip != nil {
+		reply = append(append(reply, 0x04), ip.To16()...)
+	} else {
+		reply = append(reply, 0x01, 0, 0, 0, 0)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+func socks5ReadAddr(r io.Reader) (string, int, error) {
+	var atyp [1]byte
+	_, err := io.ReadFull(r, atyp[:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case 0x01, 0x04:
+		ip := make([]byte, 4)
+		if atyp[0] == 0x04 {
+			ip = make([]byte, 16)
+		}
+		_, err = io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		var length [1]byte
+		_, err = io.ReadFull(r, length[:])
+		if err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, length[0])
+		_, err = io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("socks5 invalid address type %d", atyp[0])
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(r, port[:])
+	if err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+func (s *Socks5Server) auth(conn net.Conn) error {
+	var head [2]byte
+	_, err := io.ReadFull(conn, head[:])
+	if err != nil {
+		return err
+	}
+	if head[0] != 0x05 {
+		return fmt.Errorf("socks5 invalid version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return err
+	}
+
+	want := byte(0x00)
+	if len(s.users) > 0 {
+		want = 0x02
+	}
+	found := false
+	for _, v := range methods {
+		if v == want {
+			found = true
+		}
+	}
+	if !found {
+		conn.Write([]byte{0x05, 0xFF})
+		return errors.New("socks5 no acceptable authentication method")
+	}
+	_, err = conn.Write([]byte{0x05, want})
+	if err != nil || want == 0x00 {
+		return err
+	}
+
+	// RFC1929 用户名密码认证
+	var ver [2]byte
+	_, err = io.ReadFull(conn, ver[:])
+	if err != nil {
+		return err
+	}
+	user := make([]byte, ver[1])
+	_, err = io.ReadFull(conn, user)
+	if err != nil {
+		return err
+	}
+	var plen [1]byte
+	_, err = io.ReadFull(conn, plen[:])
+	if err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	_, err = io.ReadFull(conn, pass)
+	if err != nil {
+		return err
+	}
+
+	password, ok := s.users[string(user)]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), pass) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return fmt.Errorf("socks5 user %s authentication failed", string(user))
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+func (s *Socks5Server) Serve(localconn net.Conn) {
+	defer localconn.Close()
+
+	localconn.SetDeadline(time.Now().Add(30 * time.Second))
+	err := s.auth(localconn)
+	if err != nil {
+		log.Printf("%s %s", localconn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	var head [3]byte
+	_, err = io.ReadFull(localconn, head[:])
+	if err != nil {
+		return
+	}
+	host, port, err := socks5ReadAddr(localconn)
+	if err != nil {
+		log.Printf("%s %s", localconn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	switch {
+	case head[1] == socks5Connect:
+	case head[1] == socks5Associate && s.udp:
+		localconn.SetDeadline(time.Time{})
+		s.associate(localconn, port)
+		return
+	default:
+		socks5Reply(localconn, socks5CmdUnsupported, nil)
+		return
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	address, err := s.policy.Resolve(host, port)
+	if err != nil {
+		log.Printf("%s socks5 connect %s, %s", localconn.RemoteAddr().String(), target, err.Error())
+		rep := byte(socks5NotAllowed)
+		var dnserr *net.DNSError
+		if errors.As(err, &dnserr) {
+			rep = socks5HostUnreachable
+		}
+		socks5Reply(localconn, rep, nil)
+		return
+	}
+
+	remoteconn, err := s.dialer.Dial(address, 10*time.Second)
+	if err != nil {
+		log.Printf("%s socks5 connect %s, %s", localconn.RemoteAddr().String(), target, err.Error())
+		socks5Reply(localconn, socks5HostUnreachable, nil)
+		return
+	}
+
+	err = socks5Reply(localconn, socks5Succeeded, remoteconn.LocalAddr())
+	if err != nil {
+		remoteconn.Close()
+		return
+	}
+	localconn.SetDeadline(time.Time{})
+
+	if s.tls != nil {
+		remotetls := s.tls.Clone()
+		remotetls.ServerName = host
+		remoteconn = tls.Client(remoteconn, remotetls)
+	}
+
+	log.Println("socks5 connect to ", target)
+	tcpProxyProcess(localconn, remoteconn, nil)
+}
+
+// UDP ASSOCIATE: 只转发来自该客户端IP的数据报，控制连接断开后结束。
+// 请求中给出了客户端UDP端口时以它为准，否则以第一个数据报的来源端口为准。
+// 只有客户端发送过的目标的应答才转给客户端，目标地址在会话内只解析一次。
+func (s *Socks5Server) associate(localconn net.Conn, port int) {
+	client := localconn.RemoteAddr().(*net.TCPAddr)
+
+	var peer *net.UDPAddr
+	if port != 0 {
+		peer = &net.UDPAddr{IP: client.IP, Port: port}
+	}
+
+	local := localconn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		socks5Reply(localconn, socks5Failure, nil)
+		return
+	}
+	defer relay.Close()
+
+	err = socks5Reply(localconn, socks5Succeeded, relay.LocalAddr())
+	if err != nil {
+		return
+	}
+
+	go func() {
+		io.Copy(io.Discard, localconn)
+		relay.Close()
+	}()
+
+	resolved := make(map[string]*net.UDPAddr)
+	targets := make(map[string]bool)
+	buf := make([]byte, 65535)
+	for {
+		cnt, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if from.IP.Equal(client.IP) && (peer == nil || peer.Port == from.Port) {
+			peer = from
+			if cnt < 4 || buf[2] != 0x00 {
+				continue
+			}
+			reader := &byteReader{buf: buf[3:cnt]}
+			host, port, err := socks5ReadAddr(reader)
+			if err != nil {
+				continue
+			}
+			key := net.JoinHostPort(host, strconv.Itoa(port))
+			target, ok := resolved[key]
+			if !ok {
+				address, err := s.policy.Resolve(host, port)
+				if err != nil {
+					log.Printf("%s socks5 udp %s:%d, %s", client.String(), host, port, err.Error())
+					continue
+				}
+				target, err = net.ResolveUDPAddr("udp", address)
+				if err != nil {
+					continue
+				}
+				resolved[key] = target
+				targets[target.String()] = true
+			}
+			payload := reader.buf[reader.off:]
+			relay.WriteToUDP(payload, target)
+			Add(len(payload), 0)
+			continue
+		}
+
+		// 目标应答加上SOCKS5 UDP头后转给客户端
+		if peer == nil || !targets[from.String()] {
+			continue
+		}
+		header := []byte{0x00, 0x00, 0x00}
+		if ip4 := from.IP.To4(); ip4 != nil {
+			header = append(append(header, 0x01), ip4...)
+		} else {
+			header = append(append(header, 0x04), from.IP.To16()...)
+		}
+		header = binary.BigEndian.AppendUint16(header, uint16(from.Port))
+		relay.WriteToUDP(append(header, buf[:cnt]...), peer)
+		Add(0, cnt)
+	}
+}
+
+type byteReader struct {
+	buf []byte
+	off int
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if r.off >= len(r.buf) {
+		return 0, io.EOF
+	}
+	cnt := copy(p, r.buf[r.off:])
+	r.off += cnt
+	return cnt, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocks5UdpAssociate(t *testing.T) {
+	policy, err := NewPolicy(&PolicyConfig{Allow: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSocks5Server(&Socks5Config{Udp: true}, policy, nil, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	control, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.associate(server, 0)
+
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(control, reply); err != nil || reply[1] != socks5Succeeded {
+		t.Fatalf("associate reply %v %v", reply, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	// 目标原样回显，另一个地址冒充应答
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			cnt, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			stranger.WriteToUDP([]byte("spoofed"), relay)
+			time.Sleep(50 * time.Millisecond)
+			target.WriteToUDP(buf[:cnt], from)
+		}
+	}()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	addr := target.LocalAddr().(*net.UDPAddr)
+	header := append([]byte{0x00, 0x00, 0x00, 0x01}, addr.IP.To4()...)
+	header = binary.BigEndian.AppendUint16(header, uint16(addr.Port))
+	for _, payload := range []string{"first", "second"} {
+		if _, err = client.WriteToUDP(append(header, payload...), relay); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1500)
+		cnt, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:cnt]) != string(header)+payload {
+			t.Fatalf("client received %q", buf[:cnt])
+		}
+	}
+}
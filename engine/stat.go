@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -10,8 +11,34 @@ import (
 var gtotalUpSize uint64
 var gtotalDownSize uint64
 
+const statInterval = 10 * time.Second
+
+// 每个监听地址接受新连接的计数，用于计算接入速率
+type ListenerStat struct {
+	Address string
+	accepts uint64
+	last    uint64
+}
+
+var listenerStatLock sync.Mutex
+var listenerStats []*ListenerStat
+
+func NewListenerStat(address string) *ListenerStat {
+	stat := &ListenerStat{Address: address}
+
+	listenerStatLock.Lock()
+	listenerStats = append(listenerStats, stat)
+	listenerStatLock.Unlock()
+
+	return stat
+}
+
+func (s *ListenerStat) Accept() {
+	atomic.AddUint64(&s.accepts, 1)
+}
+
 func init() {
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(statInterval)
 	go func() {
 		for {
 			<-ticker.C
@@ -28,6 +55,22 @@ func Add(up int, down int) {
 func display() {
 	log.Printf("↑%s ↓%s\n",
 		calcUnit(gtotalUpSize), calcUnit(gtotalDownSize))
+	acceptDisplay()
+	affinityDisplay()
+	certExpiryDisplay()
+	maintenanceDisplay()
+}
+
+func acceptDisplay() {
+	listenerStatLock.Lock()
+	defer listenerStatLock.Unlock()
+
+	for _, s := range listenerStats {
+		accepts := atomic.LoadUint64(&s.accepts)
+		rate := float64(accepts-s.last) / statInterval.Seconds()
+		s.last = accepts
+		log.Printf("listen %s accept %d (%.1f/s)\n", s.Address, accepts, rate)
+	}
 }
 
 func calcUnit(cnt uint64) string {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 
@@ -9,67 +10,72 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/linimbus/tcpproxy-windows/forward"
+	"github.com/linimbus/tcpproxy-windows/sockopt"
+)
+
+// 监听模式，默认为转发到集群
+const (
+	MODE_FORWARD      = "forward"
+	MODE_SOCKS5       = "socks5"
+	MODE_HTTP_CONNECT = "http-connect"
+	MODE_SNIFF        = "sniff"
+	MODE_HTTP         = "http"
 )
 
 type TcpProxy struct {
-	ListenTls  *tls.Config
-	ListenAddr string
-	RemoteTls  *tls.Config
-	RemoteAddr []string
+	ListenTls   *tls.Config
+	ListenAddr  string
+	RemoteTls   *tls.Config
+	Remote      *Balancer
+	Mirror      *TcpMirror
+	Options     *sockopt.Options
+	Acceptors   int
+	Mode        string
+	Socks5      *Socks5Server
+	HttpConnect *HttpConnectServer
+	Sniffer     *Sniffer
+	HttpRouter  *HttpRouter
+	Maintenance *Maintenance
+	stat        *ListenerStat
 }
 
-func NewTcpProxy(local string, localtls *tls.Config, remote []string, remotetls *tls.Config) *TcpProxy {
-	return &TcpProxy{ListenTls: localtls, ListenAddr: local, RemoteTls: remotetls, RemoteAddr: remote}
-}
-
-func writeFull(conn net.Conn, buf []byte) error {
-	totallen := len(buf)
-	sendcnt := 0
-
-	for {
-		cnt, err := conn.Write(buf[sendcnt:])
-		if err != nil {
-			return err
-		}
-		if cnt+sendcnt >= totallen {
-			return nil
-		}
-		sendcnt += cnt
-	}
+func NewTcpProxy(local string, localtls *tls.Config, remote *Balancer, remotetls *tls.Config) *TcpProxy {
+	return &TcpProxy{ListenTls: localtls, ListenAddr: local, RemoteTls: remotetls, Remote: remote}
 }
 
 // tcp通道互通
-func tcpChannel(up bool, prefix string, localconn net.Conn, remoteconn net.Conn, wait *sync.WaitGroup) {
+func tcpChannel(up bool, prefix string, localconn net.Conn, remoteconn net.Conn, mirror *mirrorSession, wait *sync.WaitGroup) {
 	defer wait.Done()
 	defer localconn.Close()
 	defer remoteconn.Close()
-	buf := make([]byte, 65535)
-	for {
-		cnt, err := localconn.Read(buf[0:])
-		if err != nil {
-			if cnt != 0 {
-				writeFull(remoteconn, buf[0:cnt])
-			}
-			break
-		}
+	defer mirror.Close()
+
+	count := func(cnt int64) {
 		if up {
-			Add(cnt, 0)
+			Add(int(cnt), 0)
 		} else {
-			Add(0, cnt)
+			Add(0, int(cnt))
 		}
+	}
 
-		if debug {
-			log.Printf("%s body:[%v]\r\n", prefix, buf[0:cnt])
-		}
-		err = writeFull(remoteconn, buf[0:cnt])
-		if err != nil {
-			break
+	// 调试输出和流量镜像需要逐块处理，其余情况交给转发核心选择零拷贝路径
+	var tap forward.Tap
+	if debug || mirror != nil {
+		tap = func(buf []byte) {
+			if debug {
+				log.Printf("%s body:[%v]\r\n", prefix, buf)
+			}
+			mirror.Write(buf)
 		}
 	}
+
+	forward.Copy(remoteconn, localconn, count, tap)
 }
 
 // tcp代理处理
-func tcpProxyProcess(localconn net.Conn, remoteconn net.Conn) {
+func tcpProxyProcess(localconn net.Conn, remoteconn net.Conn, mirror *mirrorSession) {
 
 	localremote := fmt.Sprintf("%s->%s",
 		localconn.RemoteAddr().String(),
@@ -83,111 +89,334 @@ func tcpProxyProcess(localconn net.Conn, remoteconn net.Conn) {
 
 	syncSem := new(sync.WaitGroup)
 	syncSem.Add(2)
-	go tcpChannel(true, localremote, localconn, remoteconn, syncSem)
-	go tcpChannel(false, remotelocal, remoteconn, localconn, syncSem)
+	go tcpChannel(true, localremote, localconn, remoteconn, mirror, syncSem)
+	go tcpChannel(false, remotelocal, remoteconn, localconn, nil, syncSem)
 	syncSem.Wait()
 
 	log.Println("close connect. ", localremote)
 }
 
-// 正向tcp代理启动和处理入口
-func (t *TcpProxy) Start() error {
-	var times int
+// 单个连接的后端选择和转发
+// 按负载均衡顺序依次尝试连接后端
+func (t *TcpProxy) dial(key string) (net.Conn, *Endpoint) {
+	for _, endpoint := range t.Remote.Next(key) {
+		// 连接前占用连接数，失败时释放
+		if !t.Remote.Acquire(endpoint) {
+			continue
+		}
+
+		remoteconn, err := t.Remote.Dial(endpoint, 0)
+		if err != nil {
+			log.Println(err.Error())
+			t.Remote.Release(endpoint)
+			t.Remote.Down(endpoint)
+			continue
+		}
+
+		// 先完成握手，证书校验或指纹不匹配时记录原因并尝试下一个后端
+		remotetls := endpoint.TlsConfig(t.RemoteTls)
+		if remotetls != nil {
+			tlsconn := tls.Client(remoteconn, remotetls)
+			tlsconn.SetDeadline(time.Now().Add(10 * time.Second))
+			err = tlsconn.Handshake()
+			if err != nil {
+				log.Printf("%s tls handshake failed, %s", endpoint.Address, err.Error())
+				tlsconn.Close()
+				t.Remote.Release(endpoint)
+				continue
+			}
+			tlsconn.SetDeadline(time.Time{})
+			remoteconn = tlsconn
+		}
+
+		log.Println("proxy connect to ", endpoint.Address)
+		t.Remote.Bind(key, endpoint)
+		return remoteconn, endpoint
+	}
+	return nil, nil
+}
 
-	listen, err := net.Listen("tcp", t.ListenAddr)
+func (t *TcpProxy) process(localconn net.Conn) {
+	err := t.Options.Apply(localconn)
 	if err != nil {
-		return err
+		log.Println(err.Error())
 	}
 
-	var remoteaddr string
-	for _, v := range t.RemoteAddr {
-		remoteaddr += v + " "
+	// 维护中按维护模式处理，排队的连接在维护结束后继续正常转发
+	if t.Maintenance != nil && t.Maintenance.Active() {
+		if !t.Maintenance.Serve(t, localconn) {
+			return
+		}
 	}
 
-	log.Printf("listen : %s -> %s", t.ListenAddr, remoteaddr)
+	if t.Sniffer != nil {
+		t.Sniffer.Serve(localconn)
+		return
+	}
 
-	for {
-		var localconn net.Conn
-		var remoteconn net.Conn
+	if t.ListenTls != nil {
+		localconn = tls.Server(localconn, t.ListenTls)
+	}
+
+	if t.HttpRouter != nil {
+		t.HttpRouter.Serve(localconn)
+		return
+	}
+
+	if t.Socks5 != nil {
+		t.Socks5.Serve(localconn)
+		return
+	}
+
+	if t.HttpConnect != nil {
+		t.HttpConnect.Serve(t, localconn)
+		return
+	}
 
-		localconn, err = listen.Accept()
+	// 按SNI或客户端证书粘性时需要先完成握手
+	if tlsconn, ok := localconn.(*tls.Conn); ok && t.Remote.affinity != nil && t.Remote.affinity.Handshake() {
+		tlsconn.SetDeadline(time.Now().Add(10 * time.Second))
+		err = tlsconn.Handshake()
 		if err != nil {
 			log.Println(err.Error())
-			continue
+			localconn.Close()
+			return
 		}
+		tlsconn.SetDeadline(time.Time{})
+	}
 
-		if t.ListenTls != nil {
-			localconn = tls.Server(localconn, t.ListenTls)
+	key := t.Remote.AffinityKey(localconn)
+
+	remoteconn, endpoint := t.dial(key)
+	if remoteconn == nil {
+		localconn.Close()
+		return
+	}
+	defer t.Remote.Release(endpoint)
+
+	tcpProxyProcess(localconn, remoteconn, t.Mirror.Session())
+}
+
+// 正向tcp代理启动和处理入口
+func (t *TcpProxy) Start() error {
+	control, err := t.Options.Control()
+	if err != nil {
+		return err
+	}
+
+	acceptors := t.Acceptors
+	if acceptors <= 0 {
+		acceptors = 1
+	}
+
+	// 多个监听套接字通过SO_REUSEPORT共享同一地址，由内核分配新连接
+	if acceptors > 1 {
+		reuseport, err := sockopt.ReusePort()
+		if err != nil {
+			return err
 		}
+		control = sockopt.Chain(reuseport, control)
+	}
 
-		for i := 0; i < len(t.RemoteAddr); i++ {
-			remoteaddr := t.RemoteAddr[times]
-			times = (times + 1) % len(t.RemoteAddr)
+	lc := net.ListenConfig{Control: control}
+	if t.Options.KeepAlive() {
+		lc.KeepAlive = -1
+	}
 
-			remoteconn, err = net.Dial("tcp", remoteaddr)
-			if err != nil {
-				log.Println(err.Error())
-				continue
+	var listens []net.Listener
+	for i := 0; i < acceptors; i++ {
+		listen, err := lc.Listen(context.Background(), "tcp", t.ListenAddr)
+		if err != nil {
+			for _, v := range listens {
+				v.Close()
 			}
+			return err
+		}
+		listens = append(listens, listen)
+	}
 
-			log.Println("proxy connect to ", remoteaddr)
-			break
+	var remoteaddr string
+	if t.Mode != "" {
+		remoteaddr = t.Mode + " "
+	}
+	if t.Remote != nil {
+		for _, v := range t.Remote.Endpoints() {
+			remoteaddr += v.Address + " "
 		}
+	}
 
-		if remoteconn == nil {
-			localconn.Close()
+	log.Printf("listen : %s -> %s (acceptors %d)", t.ListenAddr, remoteaddr, acceptors)
+
+	t.stat = NewListenerStat(t.ListenAddr)
+	for _, listen := range listens[1:] {
+		go t.accept(listen)
+	}
+	t.accept(listens[0])
+
+	return nil
+}
+
+func (t *TcpProxy) accept(listen net.Listener) {
+	for {
+		localconn, err := listen.Accept()
+		if err != nil {
+			log.Println(err.Error())
 			continue
 		}
+		t.stat.Accept()
 
-		if t.RemoteTls != nil {
-			remoteconn = tls.Client(remoteconn, t.RemoteTls)
-		}
+		go t.process(localconn)
+	}
+}
 
-		go tcpProxyProcess(localconn, remoteconn)
+// 代理模式下集群可选，配置时使用集群的源地址、套接字选项和上游代理连接目标
+func proxyBuild(v ListernerConfig) (*Policy, *Dialer, *tls.Config) {
+	policy, err := NewPolicy(v.Policy)
+	if err != nil {
+		log.Fatalf("listener %s policy %s.", v.Address, err.Error())
 	}
 
-	return nil
+	if v.Cluster == "" {
+		return policy, NewDialer(&ClusterConfig{Name: v.Address}), nil
+	}
+
+	cluster := ClusterGet(v.Cluster)
+	if cluster == nil {
+		log.Fatalf("not found %s cluster.", v.Cluster)
+	}
+
+	var remotetls *tls.Config
+	tls := TlsGet(cluster.TlsName)
+	if tls != nil {
+		remotetls = TlsClientConfig(tls, "")
+		if cluster.KeyLogFile != "" {
+			remotetls.KeyLogWriter = TlsKeyLogWriter(cluster.KeyLogFile)
+		}
+	}
+	return policy, NewDialer(cluster), remotetls
 }
 
-func TcpProxyStart() {
+func mirrorBuild(cfg *MirrorConfig) *TcpMirror {
+	var remotetls *tls.Config
 
-	listeners := listenerGetAll()
-	if 0 == len(listeners) {
-		log.Fatalln("no listenner.")
+	cluster := ClusterGet(cfg.Cluster)
+	if cluster == nil {
+		log.Fatalf("not found %s mirror cluster.", cfg.Cluster)
 	}
 
-	for _, v := range listeners {
+	if cluster.Empty() {
+		log.Fatalf("not found %s mirror cluster endpoint.", cfg.Cluster)
+	}
+
+	tls := TlsGet(cluster.TlsName)
+	if tls != nil {
+		remotetls = TlsClientConfig(tls, cluster.ServerName())
+	}
+
+	return NewTcpMirror(cfg, BalancerGet(cluster), remotetls)
+}
 
-		var localtls *tls.Config
-		var remotetls *tls.Config
+// 按监听配置创建代理实例，公共字段统一设置，各模式再补充自己的处理对象
+func listenerBuild(v ListernerConfig) *TcpProxy {
+	var localtls *tls.Config
 
-		tls := TlsGet(v.Tlsname)
-		if tls != nil {
-			localtls = TlsServerConfig(tls)
+	tls := TlsGet(v.Tlsname)
+	if tls != nil {
+		localtls = TlsServerConfig(tls)
+	}
+
+	if v.KeyLogFile != "" {
+		if localtls == nil {
+			log.Printf("listener %s has no tls, key_log_file ignored.", v.Address)
+		} else {
+			localtls.KeyLogWriter = TlsKeyLogWriter(v.KeyLogFile)
 		}
+	}
 
-		cluster := ClusterGet(v.Cluster)
-		if cluster == nil {
-			log.Fatalf("not found %s cluster.", v.Cluster)
+	tcoporxy := NewTcpProxy(v.Address, localtls, nil, nil)
+	tcoporxy.Options = v.SocketOptions
+	tcoporxy.Acceptors = v.Acceptors
+	if v.Maintenance != nil {
+		tcoporxy.Maintenance = maintenanceBuild(v)
+	}
+	if v.Mode != MODE_FORWARD {
+		tcoporxy.Mode = v.Mode
+	}
+
+	switch v.Mode {
+	case MODE_SOCKS5, MODE_HTTP_CONNECT:
+		policy, dialer, remotetls := proxyBuild(v)
+		if v.Mode == MODE_SOCKS5 {
+			tcoporxy.Socks5 = NewSocks5Server(v.Socks5, policy, dialer, remotetls)
+		} else {
+			tcoporxy.HttpConnect = NewHttpConnectServer(v.HttpConnect, policy, dialer, remotetls)
 		}
 
-		if len(cluster.Endpoint) == 0 {
-			log.Fatalf("not found %s cluster endpoint.", v.Cluster)
+		// 非CONNECT请求转发到集群
+		if v.HttpConnect != nil && v.HttpConnect.Forward {
+			cluster := ClusterGet(v.Cluster)
+			if cluster == nil || cluster.Empty() {
+				log.Fatalf("not found %s cluster endpoint.", v.Cluster)
+			}
+			tcoporxy.Remote = BalancerGet(cluster)
+			if remotetls != nil {
+				tcoporxy.RemoteTls = remotetls.Clone()
+				tcoporxy.RemoteTls.ServerName = cluster.ServerName()
+			}
 		}
+		return tcoporxy
 
-		tls = TlsGet(cluster.TlsName)
-		if tls != nil {
-			remotetls = TlsClientConfig(tls, cluster.Endpoint[0])
+	// 嗅探模式下listener的cluster作为未识别协议的默认集群
+	case MODE_SNIFF:
+		if localtls != nil {
+			log.Printf("listener %s sniff mode, tls ignored.", v.Address)
 		}
+		tcoporxy.ListenTls = nil
+		tcoporxy.Sniffer = snifferBuild(v)
+		return tcoporxy
+
+	// HTTP模式下listener的cluster作为非HTTP流量和未匹配请求的默认集群
+	case MODE_HTTP:
+		tcoporxy.HttpRouter = httpRouterBuild(v)
+		return tcoporxy
+
+	case "", MODE_FORWARD:
+	default:
+		log.Fatalf("listener %s unknown mode %s.", v.Address, v.Mode)
+	}
+
+	route := clusterRoute(v, v.Cluster)
+	tcoporxy.Remote = route.Remote
+	tcoporxy.RemoteTls = route.RemoteTls
+
+	if v.Mirror != nil {
+		tcoporxy.Mirror = mirrorBuild(v.Mirror)
+		log.Printf("listen : %s mirror %d%% to %s", v.Address, tcoporxy.Mirror.Percent, v.Mirror.Cluster)
+	}
+	return tcoporxy
+}
+
+func TcpProxyStart() {
 
-		tcoporxy := NewTcpProxy(v.Address, localtls, cluster.Endpoint, remotetls)
+	listeners := listenerGetAll()
+	if 0 == len(listeners) {
+		log.Fatalln("no listenner.")
+	}
 
-		go func() {
+	for _, v := range listeners {
+		tcoporxy := listenerBuild(v)
+		go func(v ListernerConfig) {
 			err := tcoporxy.Start()
 			if err != nil {
-				log.Fatalf("tcp proxy start failed %v.", v)
+				log.Fatalf("tcp proxy start failed %v, %s.", v, err.Error())
 			}
-		}()
+		}(v)
+	}
+
+	CertExpiryStart()
+	MaintenanceWatchStart()
+	if globalconfig.Metrics != "" {
+		go MetricsStart(globalconfig.Metrics)
 	}
 
 	for {
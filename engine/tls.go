@@ -3,28 +3,63 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"io/ioutil"
+	"io"
 	"log"
+	"os"
+	"sync"
+
+	"github.com/linimbus/tcpproxy-windows/keystore"
 )
 
+var keyLogLock sync.Mutex
+var keyLogFiles = make(map[string]*os.File)
+
+// 打开NSS格式的TLS密钥日志文件，可配合抓包工具解密TLS流量。
+// 同一文件被多个监听或集群引用时共用一个句柄。
+func TlsKeyLogWriter(filename string) io.Writer {
+	if !debug && !keylogForce {
+		log.Fatalf("key_log_file %s refused: run with -debug or -keylog-force.", filename)
+		return nil
+	}
+
+	keyLogLock.Lock()
+	defer keyLogLock.Unlock()
+
+	if file, ok := keyLogFiles[filename]; ok {
+		return file
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal(err.Error())
+		return nil
+	}
+	keyLogFiles[filename] = file
+
+	log.Printf("WARNING: TLS key log enabled, session secrets are written to %s.", filename)
+	log.Printf("WARNING: anyone with this file can decrypt the captured TLS traffic.")
+
+	return file
+}
+
 func TlsClientConfig(cfg *TlsConfig, addr string) *tls.Config {
 	var pool *x509.CertPool
+	var err error
 
 	if cfg.CA != "" {
-		buf, err := ioutil.ReadFile(cfg.CA)
+		pool, err = keystore.LoadCA(cfg.CA)
 		if err != nil {
-			log.Fatal(err.Error())
+			log.Fatalf("tls %s %s.", cfg.Name, err.Error())
 			return nil
 		}
-		pool := x509.NewCertPool()
-		pool.AppendCertsFromPEM(buf)
 	}
 
-	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	cert, err := cfg.Load()
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Fatalf("tls %s %s.", cfg.Name, err.Error())
 		return nil
 	}
+	tlsExpiryTrack(cfg, cert)
 
 	var bSkipVerify bool
 
@@ -33,34 +68,49 @@ func TlsClientConfig(cfg *TlsConfig, addr string) *tls.Config {
 		bSkipVerify = true
 	}
 
+	// 配置了指纹时无论是否有根证书都要求服务端证书匹配，配置了吊销列表时检查服务端证书是否被吊销
+	verify := tlsVerify(cfg)
+
 	return &tls.Config{
-		ServerName:         addr,
-		InsecureSkipVerify: bSkipVerify,
-		RootCAs:            pool,
-		Certificates:       []tls.Certificate{cert},
+		ServerName:            addr,
+		InsecureSkipVerify:    bSkipVerify,
+		RootCAs:               pool,
+		Certificates:          []tls.Certificate{cert},
+		VerifyPeerCertificate: verify,
 	}
 }
 
+func tlsPins(cfg *TlsConfig) func([][]byte, [][]*x509.Certificate) error {
+	if len(cfg.Pins) == 0 {
+		return nil
+	}
+	pins, err := keystore.ParsePins(cfg.Pins)
+	if err != nil {
+		log.Fatalf("tls %s %s.", cfg.Name, err.Error())
+	}
+	return pins.VerifyPeerCertificate
+}
+
 func TlsServerConfig(cfg *TlsConfig) *tls.Config {
 	var pool *x509.CertPool
+	var err error
 
 	if cfg.CA != "" {
 		//这里读取的是根证书
-		buf, err := ioutil.ReadFile(cfg.CA)
+		pool, err = keystore.LoadCA(cfg.CA)
 		if err != nil {
-			log.Fatal(err.Error())
+			log.Fatalf("tls %s %s.", cfg.Name, err.Error())
 			return nil
 		}
-		pool = x509.NewCertPool()
-		pool.AppendCertsFromPEM(buf)
 	}
 
 	//加载服务端证书
-	crt, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	crt, err := cfg.Load()
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Fatalf("tls %s %s.", cfg.Name, err.Error())
 		return nil
 	}
+	tlsExpiryTrack(cfg, crt)
 
 	var authtype tls.ClientAuthType
 
@@ -70,9 +120,22 @@ func TlsServerConfig(cfg *TlsConfig) *tls.Config {
 		authtype = tls.RequestClientCert
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{crt},
-		ClientAuth:   authtype,
-		ClientCAs:    pool,
+	// 按指纹校验客户端证书时客户端必须提供证书
+	if len(cfg.Pins) > 0 && pool == nil {
+		authtype = tls.RequireAnyClientCert
+	}
+
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{crt},
+		ClientAuth:            authtype,
+		ClientCAs:             pool,
+		VerifyPeerCertificate: tlsVerify(cfg),
+	}
+
+	// 装订OCSP响应时每次握手取最新的证书
+	if cfg.OcspStaple {
+		config.Certificates = nil
+		config.GetCertificate = TlsStapleGet(cfg, crt).GetCertificate
 	}
+	return config
 }
@@ -0,0 +1,135 @@
+// Package forward is the byte forwarding core shared by the engine and the
+// desktop links. Plain TCP pairs are handed to the kernel (splice on Linux),
+// everything else goes through pooled buffers that grow and shrink with the
+// observed read sizes, so idle sessions only pin the smallest buffer.
+package forward
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// spliceChunk bounds a single kernel copy so the counter is updated while
+// long transfers are still running.
+const spliceChunk = 256 * 1024
+
+var bufferSizes = []int{4 * 1024, 16 * 1024, 64 * 1024}
+
+var bufferPools = make([]sync.Pool, len(bufferSizes))
+
+func init() {
+	for i := range bufferPools {
+		size := bufferSizes[i]
+		bufferPools[i].New = func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+}
+
+// Counter receives the number of bytes forwarded since the previous call.
+type Counter func(cnt int64)
+
+// Tap sees every chunk after it was written to the destination. The slice
+// is only valid during the call.
+type Tap func(buf []byte)
+
+// Copy forwards src to dst until EOF or an error. The kernel path is used
+// when both sides are plain TCP connections and tap is nil.
+func Copy(dst net.Conn, src net.Conn, count Counter, tap Tap) error {
+	if tap == nil && spliceSupported {
+		dstTcp, ok1 := dst.(*net.TCPConn)
+		srcTcp, ok2 := src.(*net.TCPConn)
+		if ok1 && ok2 {
+			return copyTcp(dstTcp, srcTcp, count)
+		}
+	}
+	return CopyBuffer(dst, src, count, tap)
+}
+
+func copyTcp(dst *net.TCPConn, src *net.TCPConn, count Counter) error {
+	for {
+		cnt, err := io.CopyN(dst, src, spliceChunk)
+		if cnt > 0 && count != nil {
+			count(cnt)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CopyBuffer forwards src to dst with pooled buffers. The buffer moves to
+// the next size class when a read fills it and back down after a run of
+// small reads.
+func CopyBuffer(dst io.Writer, src io.Reader, count Counter, tap Tap) error {
+	level := 0
+	small := 0
+	buf := bufferPools[level].Get().(*[]byte)
+	defer func() {
+		bufferPools[level].Put(buf)
+	}()
+
+	for {
+		cnt, err1 := src.Read(*buf)
+		if cnt > 0 {
+			err2 := WriteFull(dst, (*buf)[:cnt])
+			if count != nil {
+				count(int64(cnt))
+			}
+			if tap != nil {
+				tap((*buf)[:cnt])
+			}
+			if err2 != nil {
+				return err2
+			}
+		}
+		if err1 == io.EOF {
+			return nil
+		}
+		if err1 != nil {
+			return err1
+		}
+
+		next := level
+		if cnt == len(*buf) && level+1 < len(bufferSizes) {
+			next = level + 1
+			small = 0
+		} else if level > 0 && cnt <= bufferSizes[level-1] {
+			small++
+			if small >= 16 {
+				next = level - 1
+				small = 0
+			}
+		} else {
+			small = 0
+		}
+
+		if next != level {
+			bufferPools[level].Put(buf)
+			level = next
+			buf = bufferPools[level].Get().(*[]byte)
+		}
+	}
+}
+
+// WriteFull writes the whole body, retrying short writes.
+func WriteFull(w io.Writer, body []byte) error {
+	begin := 0
+	for {
+		cnt, err := w.Write(body[begin:])
+		if cnt > 0 {
+			begin += cnt
+		}
+		if begin >= len(body) {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
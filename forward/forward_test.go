@@ -0,0 +1,227 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// copyLegacy is the loop the engine used before this package: one fixed
+// 64 KiB buffer per direction for the whole life of the session.
+func copyLegacy(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 65535)
+	for {
+		cnt, err := src.Read(buf)
+		if cnt > 0 {
+			if err := WriteFull(dst, buf[:cnt]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// chunkReader returns data in reads of the given sizes, cycling through
+// them, to drive the buffer up and down the size classes.
+type chunkReader struct {
+	data  []byte
+	sizes []int
+	next  int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	size := r.sizes[r.next%len(r.sizes)]
+	r.next++
+	if size > len(p) {
+		size = len(p)
+	}
+	if size > len(r.data) {
+		size = len(r.data)
+	}
+	cnt := copy(p, r.data[:size])
+	r.data = r.data[cnt:]
+	return cnt, nil
+}
+
+// shortWriter accepts at most limit bytes per call.
+type shortWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		p = p[:w.limit]
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestCopyBuffer(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	src := &chunkReader{data: data, sizes: []int{100, 70000, 70000, 70000, 10, 20, 30, 40, 50}}
+	dst := &shortWriter{limit: 1000}
+	var counted int64
+	var tapped bytes.Buffer
+	err := CopyBuffer(dst, src, func(cnt int64) { counted += cnt }, func(buf []byte) { tapped.Write(buf) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), data) || !bytes.Equal(tapped.Bytes(), data) {
+		t.Fatal("forwarded data differs from the source")
+	}
+	if counted != int64(len(data)) {
+		t.Fatalf("counted %d bytes, want %d", counted, len(data))
+	}
+}
+
+func benchmarkCopy(b *testing.B, sizes []int, fn func(io.Writer, io.Reader) error) {
+	data := make([]byte, 16<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := fn(io.Discard, &chunkReader{data: data, sizes: sizes})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func copyPooled(dst io.Writer, src io.Reader) error {
+	return CopyBuffer(dst, src, nil, nil)
+}
+
+func BenchmarkCopyBulk(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) { benchmarkCopy(b, []int{1 << 20}, copyPooled) })
+	b.Run("legacy", func(b *testing.B) { benchmarkCopy(b, []int{1 << 20}, copyLegacy) })
+}
+
+func BenchmarkCopyInteractive(b *testing.B) {
+	sizes := []int{200, 1400, 60, 4000}
+	b.Run("pooled", func(b *testing.B) { benchmarkCopy(b, sizes, copyPooled) })
+	b.Run("legacy", func(b *testing.B) { benchmarkCopy(b, sizes, copyLegacy) })
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return client, server
+}
+
+// benchmarkTCP sends data through a relay between two loopback
+// connections, the way a proxy session forwards one direction.
+func benchmarkTCP(b *testing.B, relay func(dst net.Conn, src net.Conn) error) {
+	const total = 64 << 20
+	chunk := make([]byte, 256<<10)
+	b.SetBytes(total)
+
+	for i := 0; i < b.N; i++ {
+		sender, in := tcpPair(b)
+		out, receiver := tcpPair(b)
+
+		done := make(chan error, 1)
+		go func() {
+			err := relay(out, in)
+			out.Close()
+			done <- err
+		}()
+		go func() {
+			for sent := 0; sent < total; sent += len(chunk) {
+				if _, err := sender.Write(chunk); err != nil {
+					break
+				}
+			}
+			sender.Close()
+		}()
+
+		cnt, err := io.Copy(io.Discard, receiver)
+		if err != nil || cnt != total {
+			b.Fatalf("received %d bytes, %v", cnt, err)
+		}
+		if err = <-done; err != nil {
+			b.Fatal(err)
+		}
+		in.Close()
+		receiver.Close()
+	}
+}
+
+func BenchmarkCopyTCP(b *testing.B) {
+	b.Run("forward", func(b *testing.B) {
+		benchmarkTCP(b, func(dst net.Conn, src net.Conn) error { return Copy(dst, src, nil, nil) })
+	})
+	b.Run("legacy", func(b *testing.B) {
+		benchmarkTCP(b, func(dst net.Conn, src net.Conn) error { return copyLegacy(dst, src) })
+	})
+}
+
+// benchmarkIdle opens sessions that forwarded a little data and then sit
+// idle in Read, and reports the heap each one keeps.
+func benchmarkIdle(b *testing.B, fn func(io.Writer, io.Reader) error) {
+	const sessions = 1000
+	payload := make([]byte, 512)
+
+	var heap float64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		var wait sync.WaitGroup
+		ends := make([]net.Conn, sessions)
+		for j := range ends {
+			local, remote := net.Pipe()
+			ends[j] = local
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				fn(io.Discard, remote)
+			}()
+			local.Write(payload)
+		}
+		// let every session return to the blocking Read
+		time.Sleep(50 * time.Millisecond)
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		heap += float64(after.HeapAlloc) - float64(before.HeapAlloc)
+
+		for _, conn := range ends {
+			conn.Close()
+		}
+		wait.Wait()
+	}
+	b.ReportMetric(heap/float64(b.N)/sessions, "heap-B/session")
+}
+
+func BenchmarkCopyIdle(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) { benchmarkIdle(b, copyPooled) })
+	b.Run("legacy", func(b *testing.B) { benchmarkIdle(b, copyLegacy) })
+}
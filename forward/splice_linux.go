@@ -0,0 +1,6 @@
+//go:build linux
+
+package forward
+
+// TCPConn.ReadFrom uses splice(2) between two sockets.
+const spliceSupported = true
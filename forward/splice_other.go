@@ -0,0 +1,7 @@
+//go:build !linux
+
+package forward
+
+// Without splice io.Copy would allocate a fresh 32 KiB buffer per call,
+// the pooled path is cheaper.
+const spliceSupported = false
@@ -6,6 +6,7 @@ require (
 	github.com/GeertJohan/go.rice v1.0.3
 	github.com/astaxie/beego v1.12.3
 	github.com/lxn/walk v0.0.0-20210112085537-c389da54e794
+	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -13,6 +14,5 @@ require (
 	github.com/daaku/go.zipexe v1.0.2 // indirect
 	github.com/lxn/win v0.0.0-20210218163916-a377121e959e // indirect
 	github.com/shiena/ansicolor v0.0.0-20151119151921-a422bbe96644 // indirect
-	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
 )
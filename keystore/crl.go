@@ -0,0 +1,172 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CRLSet checks certificates against certificate revocation lists read
+// from files, inline PEM or http(s) URLs. Every list must be signed by
+// one of the configured issuers. A source that fails to refresh keeps
+// its last good list, so a responder outage does not lift revocations.
+type CRLSet struct {
+	sync.RWMutex
+
+	sources []string
+	issuers []*x509.Certificate
+	client  *http.Client
+	lists   map[string]*x509.RevocationList
+	revoked map[string]map[string]time.Time
+}
+
+func NewCRLSet(sources []string, issuers []*x509.Certificate) *CRLSet {
+	return &CRLSet{
+		sources: sources,
+		issuers: issuers,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		lists:   make(map[string]*x509.RevocationList),
+		revoked: make(map[string]map[string]time.Time),
+	}
+}
+
+func remoteSource(value string) bool {
+	return strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://")
+}
+
+func (c *CRLSet) read(source string) ([]byte, error) {
+	if !remoteSource(source) {
+		return ReadValue(source)
+	}
+	resp, err := c.client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+}
+
+// load reads one source, which may be DER or PEM "X509 CRL", and checks
+// its signature.
+func (c *CRLSet) load(source string) (*x509.RevocationList, error) {
+	body, err := c.read(source)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected pem block %s", block.Type)
+		}
+		body = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, err
+	}
+	for _, issuer := range c.issuers {
+		if !bytes.Equal(issuer.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		if crl.CheckSignatureFrom(issuer) == nil {
+			return crl, nil
+		}
+	}
+	return nil, errors.New("not signed by a configured ca")
+}
+
+// Refresh reloads every source. It returns the earliest NextUpdate of
+// the lists, so the caller can refresh before a list goes stale, and an
+// error describing the sources that failed.
+func (c *CRLSet) Refresh() (time.Time, error) {
+	var failed []string
+	for _, source := range c.sources {
+		crl, err := c.load(source)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("crl %s, %s", describe(source), err.Error()))
+			continue
+		}
+		c.Lock()
+		c.lists[source] = crl
+		c.Unlock()
+	}
+
+	now := time.Now()
+	var next time.Time
+	revoked := make(map[string]map[string]time.Time)
+
+	c.Lock()
+	for source, crl := range c.lists {
+		if !crl.NextUpdate.IsZero() {
+			if crl.NextUpdate.Before(now) {
+				failed = append(failed, fmt.Sprintf("crl %s expired at %s", describe(source), crl.NextUpdate.Format(time.DateTime)))
+			} else if next.IsZero() || crl.NextUpdate.Before(next) {
+				next = crl.NextUpdate
+			}
+		}
+		issuer := string(crl.RawIssuer)
+		if revoked[issuer] == nil {
+			revoked[issuer] = make(map[string]time.Time)
+		}
+		for _, v := range crl.RevokedCertificateEntries {
+			revoked[issuer][v.SerialNumber.String()] = v.RevocationTime
+		}
+	}
+	c.revoked = revoked
+	c.Unlock()
+
+	if len(failed) > 0 {
+		return next, errors.New(strings.Join(failed, "; "))
+	}
+	return next, nil
+}
+
+// Lookup reports when the certificate with serial issued by the subject
+// rawIssuer was revoked.
+func (c *CRLSet) Lookup(rawIssuer []byte, serial *big.Int) (time.Time, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	at, ok := c.revoked[string(rawIssuer)][serial.String()]
+	return at, ok
+}
+
+// Check fails when any certificate of the chain is revoked.
+func (c *CRLSet) Check(certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		if at, ok := c.Lookup(cert.RawIssuer, cert.SerialNumber); ok {
+			return fmt.Errorf("certificate %s serial %s revoked at %s",
+				cert.Subject.CommonName, cert.SerialNumber.Text(16), at.Format(time.DateTime))
+		}
+	}
+	return nil
+}
+
+// VerifyPeerCertificate has the signature of tls.Config.VerifyPeerCertificate.
+// Verified chains are used when the peer was verified against a CA,
+// otherwise the presented certificates are checked as they are.
+func (c *CRLSet) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) > 0 {
+		for _, chain := range verifiedChains {
+			err := c.Check(chain)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	certs, err := ParseChain(rawCerts)
+	if err != nil {
+		return err
+	}
+	return c.Check(certs)
+}
@@ -0,0 +1,162 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestCRL(t *testing.T, ca *testIssuer, revoked ...*testIssuer) []byte {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, v := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: v.cert.SerialNumber, RevocationTime: time.Now().Add(-time.Minute)})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCRLSetRefresh(t *testing.T) {
+	ca := issueTest(t, nil, "crl-test-ca", true)
+	good := issueTest(t, ca, "good.test", false)
+	revoked := issueTest(t, ca, "revoked.test", false)
+	crl := createTestCRL(t, ca, revoked)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(crl)
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "ca.crl")
+	err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []string{server.URL, file} {
+		set := NewCRLSet([]string{source}, []*x509.Certificate{ca.cert})
+		next, err := set.Refresh()
+		if err != nil {
+			t.Fatalf("%s: %s", source, err.Error())
+		}
+		if next.Before(time.Now()) {
+			t.Fatalf("%s: next update %s", source, next)
+		}
+		if err = set.Check([]*x509.Certificate{good.cert, ca.cert}); err != nil {
+			t.Errorf("%s: good certificate rejected, %s", source, err.Error())
+		}
+		if err = set.Check([]*x509.Certificate{revoked.cert, ca.cert}); err == nil {
+			t.Errorf("%s: revoked certificate accepted", source)
+		}
+	}
+
+	// a list signed by another CA is refused
+	other := issueTest(t, nil, "crl-test-ca", true)
+	set := NewCRLSet([]string{server.URL}, []*x509.Certificate{other.cert})
+	_, err = set.Refresh()
+	if err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Fatalf("crl of another ca returned %v", err)
+	}
+}
+
+// tlsHandshake runs a handshake of a client presenting client against a
+// server requiring certificates of ca, with set checking revocation.
+func tlsHandshake(t *testing.T, ca, server, client *testIssuer, set *CRLSet) error {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	servercfg := &tls.Config{
+		Certificates:          []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             pool,
+		VerifyPeerCertificate: set.VerifyPeerCertificate,
+	}
+	clientcfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}},
+		RootCAs:      pool,
+		ServerName:   server.cert.DNSNames[0],
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer c.Close()
+		conn := tls.Server(c, servercfg)
+		err = conn.Handshake()
+		if err == nil {
+			// TLS 1.3 reports a rejected client certificate on the first read
+			conn.Write([]byte{0})
+		}
+		result <- err
+	}()
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := tls.Client(c, clientcfg)
+	err = conn.Handshake()
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	servererr := <-result
+	if servererr != nil {
+		return servererr
+	}
+	return err
+}
+
+func TestCRLRejectsRevokedClient(t *testing.T) {
+	ca := issueTest(t, nil, "crl-test-ca", true)
+	server := issueTest(t, ca, "server.test", false, x509.ExtKeyUsageServerAuth)
+	good := issueTest(t, ca, "good-client", false, x509.ExtKeyUsageClientAuth)
+	revoked := issueTest(t, ca, "revoked-client", false, x509.ExtKeyUsageClientAuth)
+
+	file := filepath.Join(t.TempDir(), "ca.crl")
+	err := os.WriteFile(file, createTestCRL(t, ca, revoked), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := NewCRLSet([]string{file}, []*x509.Certificate{ca.cert})
+	if _, err = set.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tlsHandshake(t, ca, server, good, set); err != nil {
+		t.Fatalf("good client rejected, %s", err.Error())
+	}
+	err = tlsHandshake(t, ca, server, revoked, set)
+	if err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("revoked client returned %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultWarnDays are the days before expiry at which a warning is raised.
+var DefaultWarnDays = []int{30, 14, 7, 1}
+
+// CertExpiry describes when a tracked certificate chain expires. A chain
+// expires with the first of its certificates to expire, which is
+// usually the leaf but may be an intermediate.
+type CertExpiry struct {
+	Name     string    `json:"name"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// Days returns the whole days left before expiry, negative once expired.
+func (c *CertExpiry) Days() int {
+	left := time.Until(c.NotAfter)
+	if left < 0 {
+		return -int((-left).Hours()/24) - 1
+	}
+	return int(left.Hours() / 24)
+}
+
+type expiryEntry struct {
+	CertExpiry
+	warned int
+}
+
+// ExpiryMonitor tracks the expiry of loaded certificate chains by name.
+// Check logs a warning, and posts to the webhook when one is set, each
+// time a chain enters a tighter warning window, and once it has expired.
+type ExpiryMonitor struct {
+	sync.Mutex
+
+	warnDays []int
+	webhook  string
+	client   *http.Client
+	logf     func(format string, v ...any)
+	entries  map[string]*expiryEntry
+}
+
+func NewExpiryMonitor(logf func(format string, v ...any)) *ExpiryMonitor {
+	return &ExpiryMonitor{
+		warnDays: DefaultWarnDays,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logf:     logf,
+		entries:  make(map[string]*expiryEntry),
+	}
+}
+
+// Configure sets the warning thresholds in days and the webhook URL.
+// Empty thresholds keep the defaults.
+func (m *ExpiryMonitor) Configure(warnDays []int, webhook string) {
+	days := append([]int(nil), warnDays...)
+	if len(days) == 0 {
+		days = DefaultWarnDays
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+
+	m.Lock()
+	m.warnDays = days
+	m.webhook = webhook
+	for _, v := range m.entries {
+		v.warned = 0
+	}
+	m.Unlock()
+}
+
+// Track records a chain under name, replacing what was tracked before.
+func (m *ExpiryMonitor) Track(name string, chain []*x509.Certificate) {
+	var first *x509.Certificate
+	for _, cert := range chain {
+		if first == nil || cert.NotAfter.Before(first.NotAfter) {
+			first = cert
+		}
+	}
+	if first == nil {
+		return
+	}
+
+	m.Lock()
+	old, ok := m.entries[name]
+	if !ok || !old.NotAfter.Equal(first.NotAfter) {
+		m.entries[name] = &expiryEntry{CertExpiry: CertExpiry{
+			Name: name, Subject: first.Subject.CommonName, NotAfter: first.NotAfter}}
+	}
+	m.Unlock()
+}
+
+// TrackPair records the chain of a loaded key pair.
+func (m *ExpiryMonitor) TrackPair(name string, cert tls.Certificate) {
+	var chain []*x509.Certificate
+	for _, raw := range cert.Certificate {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+		chain = append(chain, c)
+	}
+	m.Track(name, chain)
+}
+
+func (m *ExpiryMonitor) Untrack(name string) {
+	m.Lock()
+	delete(m.entries, name)
+	m.Unlock()
+}
+
+// List returns the tracked chains, soonest to expire first.
+func (m *ExpiryMonitor) List() []CertExpiry {
+	m.Lock()
+	defer m.Unlock()
+
+	output := make([]CertExpiry, 0, len(m.entries))
+	for _, v := range m.entries {
+		output = append(output, v.CertExpiry)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].NotAfter.Before(output[j].NotAfter)
+	})
+	return output
+}
+
+// level returns 0 outside the warning window, 1 for the widest window
+// up to len(warnDays) for the tightest, and one more once expired.
+func (m *ExpiryMonitor) level(days int) int {
+	if days < 0 {
+		return len(m.warnDays) + 1
+	}
+	level := 0
+	for i, v := range m.warnDays {
+		if days <= v {
+			level = i + 1
+		}
+	}
+	return level
+}
+
+func (m *ExpiryMonitor) Check() {
+	var alerts []CertExpiry
+
+	m.Lock()
+	for _, v := range m.entries {
+		level := m.level(v.Days())
+		if level > v.warned {
+			alerts = append(alerts, v.CertExpiry)
+		}
+		v.warned = level
+	}
+	webhook := m.webhook
+	m.Unlock()
+
+	for _, v := range alerts {
+		days := v.Days()
+		if days < 0 {
+			m.logf("certificate %s (%s) expired at %s", v.Name, v.Subject, v.NotAfter.Format(time.DateTime))
+		} else {
+			m.logf("certificate %s (%s) expires in %d days at %s", v.Name, v.Subject, days, v.NotAfter.Format(time.DateTime))
+		}
+		if webhook != "" {
+			go m.notify(webhook, v)
+		}
+	}
+}
+
+type expiryEvent struct {
+	CertExpiry
+	Days    int  `json:"days"`
+	Expired bool `json:"expired"`
+}
+
+func (m *ExpiryMonitor) notify(webhook string, cert CertExpiry) {
+	days := cert.Days()
+	body, err := json.Marshal(expiryEvent{CertExpiry: cert, Days: days, Expired: days < 0})
+	if err != nil {
+		return
+	}
+	resp, err := m.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		m.logf("certificate expiry webhook %s failed, %s", webhook, err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		m.logf("certificate expiry webhook %s returned %s", webhook, resp.Status)
+	}
+}
+
+// String formats the remaining days for status views.
+func (c *CertExpiry) String() string {
+	days := c.Days()
+	if days < 0 {
+		return fmt.Sprintf("%s (%s) expired %s", c.Name, c.Subject, c.NotAfter.Format(time.DateOnly))
+	}
+	return fmt.Sprintf("%s (%s) %d days, expire %s", c.Name, c.Subject, days, c.NotAfter.Format(time.DateOnly))
+}
@@ -0,0 +1,228 @@
+// Package keystore loads TLS key material for the engine and the desktop
+// links. Certificates and keys can be PEM files, inline PEM blocks, PKCS#12
+// (.pfx) bundles, and password protected PKCS#8 or legacy OpenSSL keys.
+package keystore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Source describes where a certificate and its private key come from.
+// Cert and Key take either a file path or an inline PEM block. Pkcs12
+// replaces both with a .pfx/.p12 bundle. The password protects the
+// PKCS#12 bundle or an encrypted key and is read from Password,
+// the environment variable PasswordEnv or the file PasswordFile.
+// Password is never written as JSON, the desktop links store it
+// protected with the Windows data protection API instead.
+type Source struct {
+	Cert         string `yaml:"cert" json:"CertFile,omitempty"`
+	Key          string `yaml:"key" json:"KeyFile,omitempty"`
+	Pkcs12       string `yaml:"pkcs12" json:"Pkcs12File,omitempty"`
+	Password     string `yaml:"password" json:"-"`
+	PasswordEnv  string `yaml:"password_env" json:"PasswordEnv,omitempty"`
+	PasswordFile string `yaml:"password_file" json:"PasswordFile,omitempty"`
+}
+
+// Empty reports whether no certificate is configured.
+func (s *Source) Empty() bool {
+	return s.Cert == "" && s.Key == "" && s.Pkcs12 == ""
+}
+
+// Inline reports whether value holds PEM data rather than a file path.
+func Inline(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN ")
+}
+
+// describe names a value in error messages without leaking inline keys.
+func describe(value string) string {
+	if Inline(value) {
+		return "inline pem"
+	}
+	return value
+}
+
+// ReadValue returns inline PEM data as is and reads anything else as a file.
+func ReadValue(value string) ([]byte, error) {
+	if Inline(value) {
+		return []byte(strings.TrimSpace(value)), nil
+	}
+	return os.ReadFile(value)
+}
+
+func (s *Source) password() (string, bool, error) {
+	switch {
+	case s.PasswordEnv != "":
+		value, ok := os.LookupEnv(s.PasswordEnv)
+		if !ok {
+			return "", false, fmt.Errorf("password env %s is not set", s.PasswordEnv)
+		}
+		return value, true, nil
+	case s.PasswordFile != "":
+		body, err := os.ReadFile(s.PasswordFile)
+		if err != nil {
+			return "", false, fmt.Errorf("read password file %s failed, %s", s.PasswordFile, err.Error())
+		}
+		return strings.TrimRight(string(body), "\r\n"), true, nil
+	}
+	return s.Password, s.Password != "", nil
+}
+
+// Load reads the certificate chain and private key. Leaf is always set.
+func (s *Source) Load() (tls.Certificate, error) {
+	password, hasPassword, err := s.password()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if s.Pkcs12 != "" {
+		if s.Cert != "" || s.Key != "" {
+			return tls.Certificate{}, errors.New("pkcs12 can not be combined with cert or key")
+		}
+		body, err := os.ReadFile(s.Pkcs12)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("read pkcs12 %s failed, %s", s.Pkcs12, err.Error())
+		}
+		cert, err := DecodePKCS12(body, password)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("pkcs12 %s, %s", s.Pkcs12, err.Error())
+		}
+		return cert, nil
+	}
+
+	if s.Cert == "" || s.Key == "" {
+		return tls.Certificate{}, errors.New("certificate and key must be set together")
+	}
+
+	certbody, err := ReadValue(s.Cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read certificate %s failed, %s", describe(s.Cert), err.Error())
+	}
+	keybody, err := ReadValue(s.Key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read key %s failed, %s", describe(s.Key), err.Error())
+	}
+
+	keybody, err = decryptPEM(keybody, password, hasPassword)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("key %s, %s", describe(s.Key), err.Error())
+	}
+
+	cert, err := tls.X509KeyPair(certbody, keybody)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("certificate %s with key %s, %s", describe(s.Cert), describe(s.Key), err.Error())
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("certificate %s, %s", describe(s.Cert), err.Error())
+	}
+	return cert, nil
+}
+
+// decryptPEM turns an encrypted PEM key into an unencrypted PKCS#8 block.
+// Unencrypted keys are returned unchanged.
+func decryptPEM(body []byte, password string, hasPassword bool) ([]byte, error) {
+	rest := body
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return body, nil
+		}
+
+		// legacy OpenSSL "Proc-Type: 4,ENCRYPTED" keys
+		//lint:ignore SA1019 still produced by older tooling
+		legacy := x509.IsEncryptedPEMBlock(block)
+		if block.Type != "ENCRYPTED PRIVATE KEY" && !legacy {
+			continue
+		}
+		if !hasPassword {
+			return nil, errors.New("private key is encrypted but no password is configured")
+		}
+
+		var der []byte
+		if legacy {
+			//lint:ignore SA1019 still produced by older tooling
+			plain, err := x509.DecryptPEMBlock(block, []byte(password))
+			if err != nil {
+				return nil, ErrPassword
+			}
+			key, err := parsePrivateKey(plain)
+			if err != nil {
+				return nil, err
+			}
+			der, err = x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			key, err := DecryptPKCS8(block.Bytes, password)
+			if err != nil {
+				return nil, err
+			}
+			der, err = x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+}
+
+func parsePrivateKey(der []byte) (any, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, ErrPassword
+}
+
+// LoadCA reads a CA bundle from a file or inline PEM. At least one
+// certificate must be present.
+func LoadCA(value string) (*x509.CertPool, error) {
+	certs, err := LoadCerts(value)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// LoadCerts reads the certificates of a PEM bundle from a file or inline PEM.
+func LoadCerts(value string) ([]*x509.Certificate, error) {
+	body, err := ReadValue(value)
+	if err != nil {
+		return nil, fmt.Errorf("read ca %s failed, %s", describe(value), err.Error())
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, body = pem.Decode(body)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse ca %s failed, %s", describe(value), err.Error())
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("ca %s has no pem certificate", describe(value))
+	}
+	return certs, nil
+}
@@ -0,0 +1,482 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OCSP certificate status, RFC 6960 section 4.2.1.
+const (
+	OCSPGood = iota
+	OCSPRevoked
+	OCSPUnknown
+)
+
+// OCSP response status for responses without a body.
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+	ocspUnauthorized     = 6
+)
+
+var (
+	oidOCSPBasic        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA256WithRSA    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidSHA1WithRSA      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidECDSAWithSHA256  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidECDSAWithSHA1    = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidEd25519Signature = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	Version       int              `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName pkix.RDNSequence `asn1:"explicit,tag:1,optional"`
+	RequestList   []singleRequest
+}
+
+type singleRequest struct {
+	Cert certID
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []singleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// OCSPResponse is a verified answer of an OCSP responder for one
+// certificate. Raw is the complete DER response as it is stapled.
+type OCSPResponse struct {
+	Status       int
+	SerialNumber *big.Int
+	ThisUpdate   time.Time
+	NextUpdate   time.Time
+	RevokedAt    time.Time
+	Raw          []byte
+}
+
+// issuerHashes returns the hashes of the issuer name and public key
+// that identify certificates of this issuer in OCSP.
+func issuerHashes(issuer *x509.Certificate, h func() hash.Hash) ([]byte, []byte, error) {
+	var spki subjectPublicKeyInfo
+	_, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := h()
+	name.Write(issuer.RawSubject)
+	key := h()
+	key.Write(spki.PublicKey.RightAlign())
+	return name.Sum(nil), key.Sum(nil), nil
+}
+
+// match reports whether id names a certificate of issuer.
+func (id *certID) match(issuer *x509.Certificate) bool {
+	h, err := hashByOID(id.HashAlgorithm.Algorithm)
+	if err != nil {
+		return false
+	}
+	name, key, err := issuerHashes(issuer, h)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(name, id.NameHash) && bytes.Equal(key, id.IssuerKeyHash)
+}
+
+// CreateOCSPRequest builds a DER request for cert, identified by SHA-1
+// hashes as most responders expect.
+func CreateOCSPRequest(cert, issuer *x509.Certificate) ([]byte, error) {
+	name, key, err := issuerHashes(issuer, sha1.New)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspRequest{
+		TBSRequest: tbsRequest{
+			RequestList: []singleRequest{{
+				Cert: certID{
+					HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+					NameHash:      name,
+					IssuerKeyHash: key,
+					SerialNumber:  cert.SerialNumber,
+				},
+			}},
+		},
+	})
+}
+
+func signatureAlgorithm(oid asn1.ObjectIdentifier) (x509.SignatureAlgorithm, error) {
+	switch {
+	case oid.Equal(oidSHA256WithRSA):
+		return x509.SHA256WithRSA, nil
+	case oid.Equal(oidSHA384WithRSA):
+		return x509.SHA384WithRSA, nil
+	case oid.Equal(oidSHA512WithRSA):
+		return x509.SHA512WithRSA, nil
+	case oid.Equal(oidSHA1WithRSA):
+		return x509.SHA1WithRSA, nil
+	case oid.Equal(oidECDSAWithSHA256):
+		return x509.ECDSAWithSHA256, nil
+	case oid.Equal(oidECDSAWithSHA384):
+		return x509.ECDSAWithSHA384, nil
+	case oid.Equal(oidECDSAWithSHA512):
+		return x509.ECDSAWithSHA512, nil
+	case oid.Equal(oidECDSAWithSHA1):
+		return x509.ECDSAWithSHA1, nil
+	case oid.Equal(oidEd25519Signature):
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %s", oid.String())
+}
+
+func ocspStatusError(status asn1.Enumerated) error {
+	switch status {
+	case ocspMalformedRequest:
+		return errors.New("ocsp responder: malformed request")
+	case ocspInternalError:
+		return errors.New("ocsp responder: internal error")
+	case 3:
+		return errors.New("ocsp responder: try later")
+	case 5:
+		return errors.New("ocsp responder: signature required")
+	case ocspUnauthorized:
+		return errors.New("ocsp responder: unauthorized")
+	}
+	return fmt.Errorf("ocsp responder: status %d", status)
+}
+
+// ParseOCSPResponse checks that der is a response for cert signed by
+// issuer, or by a responder certificate the issuer delegated OCSP
+// signing to, and that it is current.
+func ParseOCSPResponse(der []byte, cert, issuer *x509.Certificate) (*OCSPResponse, error) {
+	var resp ocspResponse
+	rest, err := asn1.Unmarshal(der, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("parse ocsp response failed, %s", err.Error())
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data in ocsp response")
+	}
+	if resp.Status != ocspSuccessful {
+		return nil, ocspStatusError(resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, errors.New("ocsp response is not a basic response")
+	}
+
+	var basic basicResponse
+	_, err = asn1.Unmarshal(resp.Response.Response, &basic)
+	if err != nil {
+		return nil, fmt.Errorf("parse ocsp basic response failed, %s", err.Error())
+	}
+
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(responder.Raw, issuer.Raw) {
+			err = responder.CheckSignatureFrom(issuer)
+			if err != nil {
+				return nil, fmt.Errorf("ocsp responder certificate is not issued by %s", issuer.Subject.CommonName)
+			}
+			delegated := false
+			for _, v := range responder.ExtKeyUsage {
+				if v == x509.ExtKeyUsageOCSPSigning {
+					delegated = true
+				}
+			}
+			if !delegated {
+				return nil, errors.New("ocsp responder certificate lacks the ocsp signing usage")
+			}
+			signer = responder
+		}
+	}
+
+	alg, err := signatureAlgorithm(basic.SignatureAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = signer.CheckSignature(alg, basic.TBSResponseData.Raw, basic.Signature.RightAlign())
+	if err != nil {
+		return nil, fmt.Errorf("ocsp response signature invalid, %s", err.Error())
+	}
+
+	for _, v := range basic.TBSResponseData.Responses {
+		if v.CertID.SerialNumber.Cmp(cert.SerialNumber) != 0 || !v.CertID.match(issuer) {
+			continue
+		}
+		result := &OCSPResponse{
+			Status:       OCSPGood,
+			SerialNumber: v.CertID.SerialNumber,
+			ThisUpdate:   v.ThisUpdate,
+			NextUpdate:   v.NextUpdate,
+			Raw:          der,
+		}
+		switch {
+		case bool(v.Unknown):
+			result.Status = OCSPUnknown
+		case !v.Revoked.RevocationTime.IsZero():
+			result.Status = OCSPRevoked
+			result.RevokedAt = v.Revoked.RevocationTime
+		}
+
+		// 容忍几分钟的时钟偏差
+		now := time.Now()
+		if result.ThisUpdate.After(now.Add(5 * time.Minute)) {
+			return nil, fmt.Errorf("ocsp response is not valid before %s", result.ThisUpdate.Format(time.DateTime))
+		}
+		if !result.NextUpdate.IsZero() && result.NextUpdate.Before(now) {
+			return nil, fmt.Errorf("ocsp response expired at %s", result.NextUpdate.Format(time.DateTime))
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("ocsp response has no status for serial %s", cert.SerialNumber.Text(16))
+}
+
+// FetchOCSP asks the responder at server for the status of cert.
+func FetchOCSP(server string, cert, issuer *x509.Certificate, timeout time.Duration) (*OCSPResponse, error) {
+	request, err := CreateOCSPRequest(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(server, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp responder %s returned %s", server, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ParseOCSPResponse(body, cert, issuer)
+}
+
+// OCSPResponder is a minimal responder that signs answers with the
+// issuing CA key, or with the key of Responder when the CA delegated
+// OCSP signing to it. Certificates are good unless Revoked reports them.
+// It is meant for testing stapling without a real PKI.
+type OCSPResponder struct {
+	Issuer    *x509.Certificate
+	Responder *x509.Certificate
+	Signer    crypto.Signer
+	Revoked   func(serial *big.Int) (time.Time, bool)
+	Validity  time.Duration
+}
+
+func (r *OCSPResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodPost:
+		body, err = io.ReadAll(io.LimitReader(req.Body, 64<<10))
+	case http.MethodGet:
+		// RFC 6960 appendix A.1: base64 of the DER request in the path
+		var path string
+		path, err = url.PathUnescape(strings.TrimPrefix(req.URL.Path, "/"))
+		if err == nil {
+			body, err = base64.StdEncoding.DecodeString(path)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp []byte
+	if err != nil {
+		resp, _ = asn1.Marshal(ocspResponse{Status: ocspMalformedRequest})
+	} else {
+		resp = r.respond(body)
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+func (r *OCSPResponder) respond(der []byte) []byte {
+	var request ocspRequest
+	_, err := asn1.Unmarshal(der, &request)
+	if err != nil || len(request.TBSRequest.RequestList) == 0 {
+		resp, _ := asn1.Marshal(ocspResponse{Status: ocspMalformedRequest})
+		return resp
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	validity := r.Validity
+	if validity <= 0 {
+		validity = time.Hour
+	}
+
+	var responses []singleResponse
+	for _, v := range request.TBSRequest.RequestList {
+		if !v.Cert.match(r.Issuer) {
+			resp, _ := asn1.Marshal(ocspResponse{Status: ocspUnauthorized})
+			return resp
+		}
+		single := singleResponse{
+			CertID:     v.Cert,
+			ThisUpdate: now,
+			NextUpdate: now.Add(validity),
+		}
+		if r.Revoked != nil {
+			if at, ok := r.Revoked(v.Cert.SerialNumber); ok {
+				single.Revoked = revokedInfo{RevocationTime: at.UTC()}
+			}
+		}
+		if single.Revoked.RevocationTime.IsZero() {
+			single.Good = true
+		}
+		responses = append(responses, single)
+	}
+
+	resp, err := r.sign(now, responses)
+	if err != nil {
+		resp, _ = asn1.Marshal(ocspResponse{Status: ocspInternalError})
+	}
+	return resp
+}
+
+func (r *OCSPResponder) sign(now time.Time, responses []singleResponse) ([]byte, error) {
+	signer := r.Issuer
+	var certs []asn1.RawValue
+	if r.Responder != nil {
+		signer = r.Responder
+		certs = []asn1.RawValue{{FullBytes: r.Responder.Raw}}
+	}
+	_, keyHash, err := issuerHashes(signer, sha1.New)
+	if err != nil {
+		return nil, err
+	}
+	responderID, err := asn1.Marshal(keyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs, err := asn1.Marshal(responseData{
+		RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderID},
+		ProducedAt:     now,
+		Responses:      responses,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var oid asn1.ObjectIdentifier
+	var digest []byte
+	var opts crypto.SignerOpts
+	switch r.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		oid, opts = oidSHA256WithRSA, crypto.SHA256
+	case *ecdsa.PublicKey:
+		oid, opts = oidECDSAWithSHA256, crypto.SHA256
+	case ed25519.PublicKey:
+		oid, opts, digest = oidEd25519Signature, crypto.Hash(0), tbs
+	default:
+		return nil, errors.New("unsupported responder key")
+	}
+	if digest == nil {
+		sum := sha256.Sum256(tbs)
+		digest = sum[:]
+	}
+
+	signature, err := r.Signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	basic, err := asn1.Marshal(basicResponse{
+		TBSResponseData:    responseData{Raw: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+		Certificates:       certs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspResponse{
+		Status:   ocspSuccessful,
+		Response: responseBytes{ResponseType: oidOCSPBasic, Response: basic},
+	})
+}
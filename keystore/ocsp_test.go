@@ -0,0 +1,207 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var testSerial int64
+
+// issueTest signs a certificate for name with parent, or self signs it
+// when parent is nil.
+func issueTest(t *testing.T, parent *testIssuer, name string, ca bool, usage ...x509.ExtKeyUsage) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+		ExtKeyUsage:           usage,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.DNSNames = []string{name}
+	}
+
+	signerCert, signerKey := template, crypto.Signer(key)
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{cert: cert, key: key}
+}
+
+func TestFetchOCSP(t *testing.T) {
+	ca := issueTest(t, nil, "ocsp-test-ca", true)
+	good := issueTest(t, ca, "good.test", false)
+	revoked := issueTest(t, ca, "revoked.test", false)
+	revokedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+
+	responder := &OCSPResponder{Issuer: ca.cert, Signer: ca.key,
+		Revoked: func(serial *big.Int) (time.Time, bool) {
+			return revokedAt, serial.Cmp(revoked.cert.SerialNumber) == 0
+		}}
+	server := httptest.NewServer(responder)
+	defer server.Close()
+
+	resp, err := FetchOCSP(server.URL, good.cert, ca.cert, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != OCSPGood || resp.NextUpdate.Before(time.Now()) || len(resp.Raw) == 0 {
+		t.Fatalf("good certificate answered %+v", resp)
+	}
+
+	resp, err = FetchOCSP(server.URL, revoked.cert, ca.cert, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != OCSPRevoked || !resp.RevokedAt.Equal(revokedAt) {
+		t.Fatalf("revoked certificate answered %+v", resp)
+	}
+
+	// the responder refuses certificates of another CA
+	other := issueTest(t, nil, "other-ca", true)
+	_, err = FetchOCSP(server.URL, issueTest(t, other, "other.test", false).cert, other.cert, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Fatalf("foreign certificate returned %v", err)
+	}
+}
+
+func TestFetchOCSPDelegated(t *testing.T) {
+	ca := issueTest(t, nil, "ocsp-test-ca", true)
+	leaf := issueTest(t, ca, "leaf.test", false)
+	delegate := issueTest(t, ca, "ocsp-signer", false, x509.ExtKeyUsageOCSPSigning)
+
+	server := httptest.NewServer(&OCSPResponder{Issuer: ca.cert, Responder: delegate.cert, Signer: delegate.key})
+	defer server.Close()
+
+	resp, err := FetchOCSP(server.URL, leaf.cert, ca.cert, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != OCSPGood {
+		t.Fatalf("delegated response status %d", resp.Status)
+	}
+
+	// a certificate without the OCSP signing usage can not sign for the CA
+	plain := issueTest(t, ca, "not-ocsp-signer", false)
+	server.Config.Handler = &OCSPResponder{Issuer: ca.cert, Responder: plain.cert, Signer: plain.key}
+	_, err = FetchOCSP(server.URL, leaf.cert, ca.cert, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "ocsp signing usage") {
+		t.Fatalf("responder without ocsp signing usage returned %v", err)
+	}
+
+	// the delegated signer must be issued by the same CA
+	other := issueTest(t, nil, "other-ca", true)
+	foreign := issueTest(t, other, "foreign-signer", false, x509.ExtKeyUsageOCSPSigning)
+	server.Config.Handler = &OCSPResponder{Issuer: ca.cert, Responder: foreign.cert, Signer: foreign.key}
+	_, err = FetchOCSP(server.URL, leaf.cert, ca.cert, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "not issued by") {
+		t.Fatalf("responder of another ca returned %v", err)
+	}
+}
+
+func TestFetchOCSPBadSignature(t *testing.T) {
+	ca := issueTest(t, nil, "ocsp-test-ca", true)
+	leaf := issueTest(t, ca, "leaf.test", false)
+	other := issueTest(t, nil, "ocsp-test-ca", true)
+
+	// signed by a CA with the same name but another key
+	server := httptest.NewServer(&OCSPResponder{Issuer: ca.cert, Signer: other.key})
+	defer server.Close()
+
+	_, err := FetchOCSP(server.URL, leaf.cert, ca.cert, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "signature invalid") {
+		t.Fatalf("response signed by another key returned %v", err)
+	}
+}
+
+// ocspCrafted answers every request with a single response built by fn,
+// signed with the CA key.
+func ocspCrafted(r *OCSPResponder, fn func(id certID, now time.Time) singleResponse) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var request ocspRequest
+		body, _ := io.ReadAll(req.Body)
+		_, err := asn1.Unmarshal(body, &request)
+		if err != nil || len(request.TBSRequest.RequestList) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		resp, err := r.sign(now, []singleResponse{fn(request.TBSRequest.RequestList[0].Cert, now)})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	})
+}
+
+func TestFetchOCSPUnknownAndExpired(t *testing.T) {
+	ca := issueTest(t, nil, "ocsp-test-ca", true)
+	leaf := issueTest(t, ca, "leaf.test", false)
+	responder := &OCSPResponder{Issuer: ca.cert, Signer: ca.key}
+
+	server := httptest.NewServer(ocspCrafted(responder, func(id certID, now time.Time) singleResponse {
+		return singleResponse{CertID: id, Unknown: true, ThisUpdate: now, NextUpdate: now.Add(time.Hour)}
+	}))
+	defer server.Close()
+
+	resp, err := FetchOCSP(server.URL, leaf.cert, ca.cert, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != OCSPUnknown {
+		t.Fatalf("unknown certificate answered status %d", resp.Status)
+	}
+
+	server.Config.Handler = ocspCrafted(responder, func(id certID, now time.Time) singleResponse {
+		return singleResponse{CertID: id, Good: true, ThisUpdate: now.Add(-2 * time.Hour), NextUpdate: now.Add(-time.Hour)}
+	})
+	_, err = FetchOCSP(server.URL, leaf.cert, ca.cert, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expired response returned %v", err)
+	}
+
+	server.Config.Handler = ocspCrafted(responder, func(id certID, now time.Time) singleResponse {
+		return singleResponse{CertID: id, Good: true, ThisUpdate: now.Add(time.Hour)}
+	})
+	_, err = FetchOCSP(server.URL, leaf.cert, ca.cert, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "not valid before") {
+		t.Fatalf("response from the future returned %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacSHA1       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHmacSHA224     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHmacSHA256     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHmacSHA384     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHmacSHA512     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidPBEWithSHA3DES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHARC2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidSHA1           = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// ErrPassword is returned when decryption or the integrity check fails,
+// which in practice almost always means a wrong password.
+var ErrPassword = errors.New("incorrect password")
+
+// maxIterations bounds the key derivation work a file can ask for, so a
+// hostile bundle can not stall loading. Common tools use a few thousand
+// and current guidance for PBKDF2 stays well below a million.
+const maxIterations = 1000000
+
+func checkIterations(iter int) error {
+	if iter < 1 || iter > maxIterations {
+		return fmt.Errorf("unsupported iteration count %d", iter)
+	}
+	return nil
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc algorithmIdentifier
+	EncryptionScheme  algorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt      []byte
+	Iteration int
+	KeyLength int                 `asn1:"optional"`
+	Prf       algorithmIdentifier `asn1:"optional"`
+}
+
+type pbeParams struct {
+	Salt      []byte
+	Iteration int
+}
+
+func hashByOID(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case oid.Equal(oidHmacSHA1), oid.Equal(oidSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidHmacSHA224):
+		return sha256.New224, nil
+	case oid.Equal(oidHmacSHA256), oid.Equal(oidSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidHmacSHA384), oid.Equal(oidSHA384):
+		return sha512.New384, nil
+	case oid.Equal(oidHmacSHA512), oid.Equal(oidSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %s", oid.String())
+}
+
+// pbkdf2 implements RFC 8018 section 5.2.
+func pbkdf2(h func() hash.Hash, password []byte, salt []byte, iter int, length int) []byte {
+	prf := hmac.New(h, password)
+	size := prf.Size()
+	blocks := (length + size - 1) / size
+
+	output := make([]byte, 0, blocks*size)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		output = append(output, t...)
+	}
+	return output[:length]
+}
+
+// bmpPassword encodes a password the way PKCS#12 expects it for the
+// legacy PBE schemes and the MAC: UTF-16BE with a trailing NUL.
+func bmpPassword(password string) []byte {
+	codes := utf16.Encode([]rune(password))
+	output := make([]byte, 0, 2*len(codes)+2)
+	for _, v := range codes {
+		output = append(output, byte(v>>8), byte(v))
+	}
+	return append(output, 0, 0)
+}
+
+// pkcs12KDF implements RFC 7292 appendix B.2. id is 1 for keys, 2 for
+// IVs and 3 for MAC keys.
+func pkcs12KDF(h func() hash.Hash, id byte, password []byte, salt []byte, iter int, length int) []byte {
+	hasher := h()
+	u := hasher.Size()
+	v := hasher.BlockSize()
+
+	fill := func(src []byte) []byte {
+		if len(src) == 0 {
+			return nil
+		}
+		size := v * ((len(src) + v - 1) / v)
+		output := make([]byte, size)
+		for i := range output {
+			output[i] = src[i%len(src)]
+		}
+		return output
+	}
+
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	block := append(fill(salt), fill(password)...)
+
+	output := make([]byte, 0, length+u)
+	for len(output) < length {
+		hasher.Reset()
+		hasher.Write(d)
+		hasher.Write(block)
+		a := hasher.Sum(nil)
+		for i := 1; i < iter; i++ {
+			hasher.Reset()
+			hasher.Write(a)
+			a = hasher.Sum(a[:0])
+		}
+		output = append(output, a...)
+
+		// block_j = (block_j + B + 1) mod 2^(v*8) for every v sized chunk
+		b := fill(a)[:v]
+		for j := 0; j < len(block); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(block[j+k]) + int(b[k]) + carry
+				block[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return output[:length]
+}
+
+func unpad(data []byte, size int) ([]byte, error) {
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, ErrPassword
+	}
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > size {
+		return nil, ErrPassword
+	}
+	for _, v := range data[len(data)-pad:] {
+		if int(v) != pad {
+			return nil, ErrPassword
+		}
+	}
+	return data[:len(data)-pad], nil
+}
+
+func decryptCBC(block cipher.Block, iv []byte, data []byte) ([]byte, error) {
+	if len(iv) != block.BlockSize() || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted data length")
+	}
+	output := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(output, data)
+	return unpad(output, block.BlockSize())
+}
+
+// decrypt handles the password based encryption schemes found in
+// encrypted PKCS#8 keys and PKCS#12 bundles: PBES2 with PBKDF2 and
+// AES or 3DES, and the PKCS#12 pbeWithSHAAnd3-KeyTripleDES-CBC scheme.
+func decrypt(alg algorithmIdentifier, password string, data []byte) ([]byte, error) {
+	switch {
+	case alg.Algorithm.Equal(oidPBES2):
+		return decryptPBES2(alg.Parameters.FullBytes, password, data)
+	case alg.Algorithm.Equal(oidPBEWithSHA3DES):
+		var params pbeParams
+		_, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params)
+		if err != nil {
+			return nil, err
+		}
+		err = checkIterations(params.Iteration)
+		if err != nil {
+			return nil, err
+		}
+		pass := bmpPassword(password)
+		key := pkcs12KDF(sha1.New, 1, pass, params.Salt, params.Iteration, 24)
+		iv := pkcs12KDF(sha1.New, 2, pass, params.Salt, params.Iteration, 8)
+		block, err := des.NewTripleDESCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return decryptCBC(block, iv, data)
+	case alg.Algorithm.Equal(oidPBEWithSHARC2):
+		return nil, errors.New("legacy RC2 encryption is not supported, export again with AES256-SHA256")
+	}
+	return nil, fmt.Errorf("unsupported encryption algorithm %s", alg.Algorithm.String())
+}
+
+func decryptPBES2(der []byte, password string, data []byte) ([]byte, error) {
+	var params pbes2Params
+	_, err := asn1.Unmarshal(der, &params)
+	if err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s", params.KeyDerivationFunc.Algorithm.String())
+	}
+
+	var kdf pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, err
+	}
+	err = checkIterations(kdf.Iteration)
+	if err != nil {
+		return nil, err
+	}
+	prf := sha1.New
+	if len(kdf.Prf.Algorithm) > 0 {
+		prf, err = hashByOID(kdf.Prf.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := params.EncryptionScheme.Algorithm
+	keylen := 0
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		keylen = 16
+	case scheme.Equal(oidAES192CBC):
+		keylen = 24
+	case scheme.Equal(oidAES256CBC):
+		keylen = 32
+	case scheme.Equal(oidDESEDE3CBC):
+		keylen = 24
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s", scheme.String())
+	}
+
+	key := pbkdf2(prf, []byte(password), kdf.Salt, kdf.Iteration, keylen)
+
+	var block cipher.Block
+	if scheme.Equal(oidDESEDE3CBC) {
+		block, err = des.NewTripleDESCipher(key)
+	} else {
+		block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decryptCBC(block, iv, data)
+}
@@ -0,0 +1,125 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PinSet holds SHA-256 pins of peer certificates. A pin is either
+// "sha256/<base64>" of the SubjectPublicKeyInfo, which survives
+// certificate renewal with the same key, or the hex SHA-256 fingerprint
+// of the whole certificate, optionally with colons or a "sha256:" prefix.
+// Several pins can be configured so a new key can be added before the
+// old one is retired.
+type PinSet struct {
+	spki map[string]bool
+	cert map[string]bool
+}
+
+func ParsePins(list []string) (*PinSet, error) {
+	p := &PinSet{spki: make(map[string]bool), cert: make(map[string]bool)}
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.HasPrefix(v, "sha256/") {
+			sum, err := base64.StdEncoding.DecodeString(v[len("sha256/"):])
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("invalid spki pin %s", v)
+			}
+			p.spki[string(sum)] = true
+			continue
+		}
+		value := strings.ReplaceAll(strings.TrimPrefix(strings.ToLower(v), "sha256:"), ":", "")
+		sum, err := hex.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate fingerprint %s", v)
+		}
+		p.cert[string(sum)] = true
+	}
+	return p, nil
+}
+
+func (p *PinSet) Empty() bool {
+	return len(p.spki) == 0 && len(p.cert) == 0
+}
+
+func (p *PinSet) match(cert *x509.Certificate) bool {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	if p.spki[string(spki[:])] {
+		return true
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return p.cert[string(sum[:])]
+}
+
+// Match reports whether the leaf or a certificate of a verified chain
+// matches a pin, so an intermediate or private CA key can be pinned as
+// well as the leaf. Certificates the peer sent after its leaf are not
+// considered unless they were verified: anyone can append the public
+// certificate of a pinned server to a chain of their own.
+func (p *PinSet) Match(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) bool {
+	if p.match(leaf) {
+		return true
+	}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if p.match(cert) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VerifyPeerCertificate has the signature of tls.Config.VerifyPeerCertificate.
+// It is called even with InsecureSkipVerify, so pins also protect peers
+// with self-signed certificates. In that case only the leaf is pinned.
+func (p *PinSet) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	certs, err := ParseChain(rawCerts)
+	if err != nil {
+		return err
+	}
+	if p.Match(certs[0], verifiedChains) {
+		return nil
+	}
+	return fmt.Errorf("certificate %s matches no pin", SPKIPin(certs[0]))
+}
+
+func ParseChain(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("peer presented no certificate")
+	}
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// SPKIPin returns the "sha256/<base64>" public key pin of a certificate.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as
+// colon separated upper case hex.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	output := make([]string, len(sum))
+	for i, v := range sum {
+		output[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(output, ":")
+}
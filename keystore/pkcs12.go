@@ -0,0 +1,246 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+var (
+	oidDataContent      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedContent = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm algorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type digestInfo struct {
+	Algorithm algorithmIdentifier
+	Digest    []byte
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue   `asn1:"tag:0,explicit"`
+	Attributes []asn1.RawValue `asn1:"set,optional"`
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     algorithmIdentifier
+	EncryptedData []byte
+}
+
+// DecryptPKCS8 decrypts a DER encoded EncryptedPrivateKeyInfo.
+func DecryptPKCS8(der []byte, password string) (crypto.PrivateKey, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted private key, %s", err.Error())
+	}
+	plain, err := decrypt(info.Algorithm, password, info.EncryptedData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(plain)
+	if err != nil {
+		return nil, ErrPassword
+	}
+	return key, nil
+}
+
+func (m *macData) verify(content []byte, password string) error {
+	h, err := hashByOID(m.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	err = checkIterations(m.Iterations)
+	if err != nil {
+		return err
+	}
+
+	check := func(pass []byte) bool {
+		key := pkcs12KDF(h, 3, pass, m.MacSalt, m.Iterations, h().Size())
+		mac := hmac.New(h, key)
+		mac.Write(content)
+		return hmac.Equal(mac.Sum(nil), m.Mac.Digest)
+	}
+
+	if check(bmpPassword(password)) {
+		return nil
+	}
+	// some tools encode an empty password as an empty string instead of
+	// a single NUL character
+	if password == "" && check(nil) {
+		return nil
+	}
+	return ErrPassword
+}
+
+// DecodePKCS12 reads the private key and certificates of a PKCS#12 (.pfx)
+// bundle. The leaf certificate, the one matching the key, is returned
+// first followed by the rest of the chain.
+func DecodePKCS12(data []byte, password string) (tls.Certificate, error) {
+	var pfx pfxPdu
+	rest, err := asn1.Unmarshal(data, &pfx)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid pkcs12 data, %s", err.Error())
+	}
+	if len(rest) != 0 {
+		return tls.Certificate{}, errors.New("invalid pkcs12 data, trailing bytes")
+	}
+	if pfx.Version != 3 {
+		return tls.Certificate{}, fmt.Errorf("unsupported pkcs12 version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContent) {
+		return tls.Certificate{}, errors.New("pkcs12 public key integrity mode is not supported")
+	}
+
+	var content []byte
+	_, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &content)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid pkcs12 data, %s", err.Error())
+	}
+
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) > 0 {
+		err = pfx.MacData.verify(content, password)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	var authsafe []contentInfo
+	_, err = asn1.Unmarshal(content, &authsafe)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid pkcs12 data, %s", err.Error())
+	}
+
+	var key crypto.PrivateKey
+	var certs []*x509.Certificate
+
+	for _, info := range authsafe {
+		var bags []safeBag
+		switch {
+		case info.ContentType.Equal(oidDataContent):
+			var body []byte
+			_, err = asn1.Unmarshal(info.Content.Bytes, &body)
+			if err == nil {
+				_, err = asn1.Unmarshal(body, &bags)
+			}
+		case info.ContentType.Equal(oidEncryptedContent):
+			var encrypted encryptedData
+			_, err = asn1.Unmarshal(info.Content.Bytes, &encrypted)
+			if err != nil {
+				break
+			}
+			var body []byte
+			body, err = decrypt(encrypted.EncryptedContentInfo.ContentEncryptionAlgorithm, password,
+				encrypted.EncryptedContentInfo.EncryptedContent)
+			if err == nil {
+				_, err = asn1.Unmarshal(body, &bags)
+			}
+		default:
+			err = fmt.Errorf("unsupported pkcs12 content type %s", info.ContentType.String())
+		}
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		for _, bag := range bags {
+			switch {
+			case bag.Id.Equal(oidCertBag):
+				var cb certBag
+				_, err = asn1.Unmarshal(bag.Value.Bytes, &cb)
+				if err != nil {
+					return tls.Certificate{}, fmt.Errorf("invalid pkcs12 certificate bag, %s", err.Error())
+				}
+				if !cb.Id.Equal(oidX509Certificate) {
+					continue
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return tls.Certificate{}, fmt.Errorf("invalid pkcs12 certificate, %s", err.Error())
+				}
+				certs = append(certs, cert)
+			case bag.Id.Equal(oidKeyBag):
+				key, err = x509.ParsePKCS8PrivateKey(bag.Value.Bytes)
+				if err != nil {
+					return tls.Certificate{}, fmt.Errorf("invalid pkcs12 private key, %s", err.Error())
+				}
+			case bag.Id.Equal(oidShroudedKeyBag):
+				key, err = DecryptPKCS8(bag.Value.Bytes, password)
+				if err != nil {
+					return tls.Certificate{}, err
+				}
+			}
+		}
+	}
+
+	if key == nil {
+		return tls.Certificate{}, errors.New("pkcs12 has no private key")
+	}
+
+	var output tls.Certificate
+	output.PrivateKey = key
+	for i, cert := range certs {
+		if publicKeyMatch(cert, key) {
+			output.Leaf = cert
+			output.Certificate = append(output.Certificate, cert.Raw)
+			certs = append(certs[:i], certs[i+1:]...)
+			break
+		}
+	}
+	if output.Leaf == nil {
+		return tls.Certificate{}, errors.New("pkcs12 has no certificate matching the private key")
+	}
+	for _, cert := range certs {
+		output.Certificate = append(output.Certificate, cert.Raw)
+	}
+	return output, nil
+}
+
+func publicKeyMatch(cert *x509.Certificate, key crypto.PrivateKey) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && public.Equal(cert.PublicKey)
+}
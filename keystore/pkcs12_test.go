@@ -0,0 +1,180 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures in testdata were generated with OpenSSL 3.0:
+//
+//	openssl pkcs12 -export -inkey leaf.key -in leaf.pem -certfile ca.pem \
+//		-keypbe AES-256-CBC -certpbe AES-256-CBC -macalg sha256 -passout pass:secret -out aes256.pfx
+//	openssl pkcs12 -export -legacy -inkey leaf.key -in leaf.pem -certfile ca.pem \
+//		-keypbe PBE-SHA1-3DES -certpbe PBE-SHA1-3DES -macalg sha1 -passout pass:secret -out legacy3des.pfx
+//	openssl pkcs8 -topk8 -v2 aes256 -v2prf hmacWithSHA256 -in leaf.key -passout pass:secret -out leaf-pkcs8.key
+//	openssl rsa -traditional -aes256 -in leaf.key -passout pass:secret -out leaf-legacy.key
+const testPassword = "secret"
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func pemBytes(t *testing.T, name string) []byte {
+	t.Helper()
+	block, _ := pem.Decode(readTestdata(t, name))
+	if block == nil {
+		t.Fatalf("%s has no pem block", name)
+	}
+	return block.Bytes
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 6070 test vectors
+	cases := []struct {
+		password, salt string
+		iter           int
+		want           string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+	}
+	for _, c := range cases {
+		want, _ := hex.DecodeString(c.want)
+		got := pbkdf2(sha1.New, []byte(c.password), []byte(c.salt), c.iter, len(want))
+		if !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %s", c.password, c.salt, c.iter, got, c.want)
+		}
+	}
+}
+
+func checkLeaf(t *testing.T, name string, chain [][]byte, leaf *x509.Certificate) {
+	t.Helper()
+	want, err := x509.ParseCertificate(pemBytes(t, "leaf.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf == nil || !leaf.Equal(want) {
+		t.Fatalf("%s: leaf is not the certificate of the key", name)
+	}
+	if len(chain) != 2 || !bytes.Equal(chain[0], want.Raw) {
+		t.Fatalf("%s: chain has %d certificates, want leaf followed by ca", name, len(chain))
+	}
+}
+
+func TestDecodePKCS12(t *testing.T) {
+	for _, name := range []string{"aes256.pfx", "legacy3des.pfx"} {
+		cert, err := DecodePKCS12(readTestdata(t, name), testPassword)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		checkLeaf(t, name, cert.Certificate, cert.Leaf)
+
+		_, err = DecodePKCS12(readTestdata(t, name), "wrong")
+		if err != ErrPassword {
+			t.Errorf("%s: wrong password returned %v, want ErrPassword", name, err)
+		}
+	}
+}
+
+func TestDecryptPKCS8(t *testing.T) {
+	der := pemBytes(t, "leaf-pkcs8.key")
+	key, err := DecryptPKCS8(der, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := x509.ParsePKCS8PrivateKey(pemBytes(t, "leaf.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.(interface{ Equal(crypto.PrivateKey) bool }).Equal(want) {
+		t.Fatal("decrypted key differs from the original")
+	}
+
+	_, err = DecryptPKCS8(der, "wrong")
+	if err != ErrPassword {
+		t.Errorf("wrong password returned %v, want ErrPassword", err)
+	}
+}
+
+func TestSourceLoadEncryptedKey(t *testing.T) {
+	for _, name := range []string{"leaf-pkcs8.key", "leaf-legacy.key"} {
+		source := Source{Cert: "testdata/leaf.pem", Key: "testdata/" + name, Password: testPassword}
+		cert, err := source.Load()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "keystore-test-leaf" {
+			t.Fatalf("%s: unexpected leaf", name)
+		}
+
+		_, err = decryptPEM(readTestdata(t, name), "wrong", true)
+		if err != ErrPassword {
+			t.Errorf("%s: wrong password returned %v, want ErrPassword", name, err)
+		}
+
+		source.Password = ""
+		_, err = source.Load()
+		if err == nil || !strings.Contains(err.Error(), "no password") {
+			t.Errorf("%s: missing password returned %v", name, err)
+		}
+	}
+}
+
+func TestIterationLimit(t *testing.T) {
+	// rewrite the PBKDF2 iteration count of the fixture to a hostile value
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(pemBytes(t, "leaf-pkcs8.key"), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kdf pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kdf.Iteration = 1 << 30
+	params.KeyDerivationFunc.Parameters.FullBytes, err = asn1.Marshal(kdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Algorithm.Parameters.FullBytes, err = asn1.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = DecryptPKCS8(der, testPassword)
+	if err == nil || !strings.Contains(err.Error(), "iteration") {
+		t.Fatalf("hostile iteration count returned %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("hostile iteration count took %s", time.Since(start))
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/astaxie/beego/logs"
+	"github.com/linimbus/tcpproxy-windows/forward"
+	"github.com/linimbus/tcpproxy-windows/sockopt"
 )
 
 type LinkChannel struct {
@@ -26,40 +29,64 @@ type LinkInstance struct {
 	config   LinkConfig
 	server   *tls.Config
 	client   *tls.Config
+	dialer   *LinkDialer
+	pins     *BackendPins
 	flow     int64
 	listen   net.Listener
 	channels map[string]*LinkChannel
+
+	maintenance *linkMaintenance
 }
 
 func NewLinkInstance(config LinkConfig) (*LinkInstance, error) {
 	address := fmt.Sprintf("%s:%d", config.Address, config.Port)
 
-	listen, err := net.Listen(config.Protocol, address)
-	if err != nil {
-		logs.Error(err.Error())
-		return nil, err
-	}
-
 	link := new(LinkInstance)
 	link.address = address
-	link.listen = listen
 	link.channels = make(map[string]*LinkChannel, 128)
 	link.config = config
 
+	var err error
 	if config.Tls != "NULL" {
-		link.server, err = TlsConfigServer(config.Address, config.Tls)
+		link.server, err = TlsConfigServer(address, &config)
 		if err != nil {
 			logs.Error(err.Error())
 			return nil, err
 		}
 	}
 
+	link.dialer, err = NewLinkDialer(config.Backend)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil, err
+	}
+
 	if config.Backend.Tls != "NULL" {
-		link.client, err = TlsConfigClient(config.Backend.Address, config.Address, config.Tls)
+		link.client, err = TlsConfigClient(address, &config.Backend, config.Address, config.Tls)
+		if err != nil {
+			logs.Error(err.Error())
+			return nil, err
+		}
+
+		link.pins, err = NewBackendPins(address, &config.Backend)
 		if err != nil {
 			logs.Error(err.Error())
 			return nil, err
 		}
+		if link.pins.Enabled() {
+			link.client.VerifyPeerCertificate = link.pins.VerifyPeerCertificate
+		}
+	}
+
+	// 证书等配置都检查通过后再监听，避免出错时遗留监听端口
+	link.listen, err = net.Listen(config.Protocol, address)
+	if err != nil {
+		logs.Error(err.Error())
+		return nil, err
+	}
+
+	if config.Maintenance != nil && config.Maintenance.Enabled {
+		link.SetMaintenance(config.Maintenance)
 	}
 
 	link.Add(1)
@@ -84,21 +111,28 @@ func (l *LinkInstance) proxy(wg *sync.WaitGroup, local net.Conn) {
 	backend := l.config.Backend
 
 	address := fmt.Sprintf("%s:%d", backend.Address, backend.Port)
+	client := l.client
 
-	if backend.Timeout == 0 {
-		remote, err = net.Dial(backend.Protocol, address)
-	} else {
-		timeout := time.Second * time.Duration(backend.Timeout)
-		remote, err = net.DialTimeout(backend.Protocol, address, timeout)
+	// 维护中按维护模式处理，fallback 模式改为连接备用后端
+	fallback, ok := l.maintenanceServe(local)
+	if !ok {
+		return
 	}
+	if fallback != "" {
+		address = fallback
+		client = nil
+	}
+
+	timeout := time.Second * time.Duration(backend.Timeout)
+	remote, err = l.dialer.Dial(backend.Protocol, address, timeout)
 
 	if err != nil {
 		logs.Error(err.Error())
 		return
 	}
 
-	if l.client != nil {
-		remote = tls.Client(remote, l.client)
+	if client != nil {
+		remote = tls.Client(remote, client)
 	}
 
 	if l.server != nil {
@@ -125,13 +159,67 @@ func (l *LinkInstance) proxy(wg *sync.WaitGroup, local net.Conn) {
 	l.Unlock()
 }
 
+type LinkDialer struct {
+	source  *sockopt.SourcePool
+	control sockopt.Control
+}
+
+// SourceAddress可以是逗号分隔的多个地址，轮流作为源地址使用。
+// 不支持SO_BINDTODEVICE的系统上，BindInterface改为使用该网卡的地址作为源地址。
+func NewLinkDialer(backend BackendConfig) (*LinkDialer, error) {
+	var err error
+	var source []string
+
+	for _, v := range strings.Split(backend.SourceAddress, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			source = append(source, v)
+		}
+	}
+
+	d := new(LinkDialer)
+	if backend.BindInterface != "" {
+		d.control, err = sockopt.BindDevice(backend.BindInterface)
+		// 同时指定了源地址时不能再用网卡地址代替，绑定失败直接报错
+		if err != nil && len(source) > 0 {
+			return nil, err
+		}
+		if err != nil {
+			iface, err := net.InterfaceByName(backend.BindInterface)
+			if err != nil {
+				return nil, err
+			}
+			address, err := InterfaceAddsGet(iface)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range address {
+				source = append(source, v.String())
+			}
+		}
+	}
+
+	d.source, err = sockopt.NewSourcePool(source)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *LinkDialer) Dial(protocol string, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, Control: d.control}
+	if local := d.source.Next(address); local != nil {
+		dialer.LocalAddr = local
+	}
+	return dialer.Dial(protocol, address)
+}
+
 func (l *LinkInstance) start() {
 	defer l.Done()
 	logs.Info("link instance %s start", l.address)
 
 	wg := new(sync.WaitGroup)
 	for {
-		if l.close {
+		if l.closed() {
 			break
 		}
 		conn, err := l.listen.Accept()
@@ -147,10 +235,20 @@ func (l *LinkInstance) start() {
 	logs.Info("link instance %s shutdown", l.address)
 }
 
+func (l *LinkInstance) closed() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.close
+}
+
 func (l *LinkInstance) Close() {
 	l.Lock()
 	l.close = true
 	l.listen.Close()
+	if l.maintenance != nil {
+		close(l.maintenance.release)
+		l.maintenance = nil
+	}
 	for _, v := range l.channels {
 		v.remote.Close()
 	}
@@ -178,18 +276,14 @@ func connect(wg *sync.WaitGroup, local net.Conn, remote net.Conn, flow *int64) {
 		wg.Done()
 	}()
 
-	var buf [8192]byte
-	for {
-		cnt, err1 := local.Read(buf[:])
-		if cnt > 0 {
-			err2 := WriteFull(remote, buf[:cnt])
-			if err2 != nil {
-				return
-			}
-			atomic.AddInt64(flow, int64(cnt))
-		}
-		if err1 != nil {
-			return
-		}
+	forward.Copy(remote, local, func(cnt int64) {
+		atomic.AddInt64(flow, cnt)
+	}, nil)
+}
+
+func (l *LinkInstance) PendingPin() string {
+	if l.pins == nil {
+		return ""
 	}
+	return l.pins.Pending()
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +46,7 @@ func LinkDelele(binds []string) {
 			if instance != nil {
 				instance.Close()
 			}
+			LinkExpiryUntrack(bind)
 			linkCtrl.Cache = append(linkCtrl.Cache[:i], linkCtrl.Cache[i+1:]...)
 			break
 		}
@@ -89,6 +91,110 @@ func LinkFind(bind string) *LinkConfig {
 	return nil
 }
 
+// 保存后端证书指纹，首次信任和确认新指纹时调用
+func LinkPinsUpdate(bind string, pins []string) {
+	linkCtrl.Lock()
+	defer linkCtrl.Unlock()
+
+	for _, v := range linkCtrl.Cache {
+		if v.Bind != bind {
+			continue
+		}
+		v.Cfg.Backend.Pins = pins
+		syncToFile()
+		logs.Info("link %s backend pins update %v", bind, pins)
+		break
+	}
+}
+
+func LinkPendingPin(bind string) string {
+	linkCtrl.RLock()
+	defer linkCtrl.RUnlock()
+
+	for _, v := range linkCtrl.Cache {
+		if v.Bind == bind && v.Instance != nil {
+			return v.Instance.PendingPin()
+		}
+	}
+	return ""
+}
+
+// 确认后端新的证书指纹，替换原有指纹并立即生效
+func LinkPinApprove(bind string) error {
+	linkCtrl.Lock()
+	defer linkCtrl.Unlock()
+
+	for _, v := range linkCtrl.Cache {
+		if v.Bind != bind || v.Instance == nil || v.Instance.pins == nil {
+			continue
+		}
+		pin := v.Instance.pins.Pending()
+		if pin == "" {
+			return fmt.Errorf("link %s has no pending backend certificate", bind)
+		}
+		v.Instance.pins.Approve(pin)
+		v.Cfg.Backend.Pins = []string{pin}
+		syncToFile()
+		logs.Warning("link %s backend pin approved %s", bind, pin)
+		return nil
+	}
+	return fmt.Errorf("link %s is not running", bind)
+}
+
+// 保存链路维护配置，链路运行中时立即切换
+func LinkMaintenanceUpdate(bind string, cfg *MaintenanceConfig) error {
+	err := cfg.Check()
+	if err != nil {
+		return err
+	}
+
+	linkCtrl.Lock()
+	defer linkCtrl.Unlock()
+
+	for _, v := range linkCtrl.Cache {
+		if v.Bind != bind {
+			continue
+		}
+		v.Cfg.Maintenance = cfg
+		if v.Instance != nil {
+			v.Instance.SetMaintenance(cfg)
+		}
+		syncToFile()
+		return nil
+	}
+	return fmt.Errorf("link %s not found", bind)
+}
+
+// 工具栏切换所选链路的维护模式，未配置维护模式的链路跳过
+func LinkMaintenanceToggle(binds []string) error {
+	linkCtrl.Lock()
+	defer linkCtrl.Unlock()
+
+	var skip []string
+	for _, bind := range binds {
+		for _, v := range linkCtrl.Cache {
+			if v.Bind != bind {
+				continue
+			}
+			if v.Cfg.Maintenance == nil {
+				skip = append(skip, bind)
+				break
+			}
+			v.Cfg.Maintenance.Enabled = !v.Cfg.Maintenance.Enabled
+			if v.Instance != nil {
+				v.Instance.SetMaintenance(v.Cfg.Maintenance)
+			}
+			break
+		}
+	}
+	syncToFile()
+
+	if len(skip) > 0 {
+		return fmt.Errorf("link %s has no maintenance config, set it in the link detail", strings.Join(skip, ", "))
+	}
+	return nil
+}
+
 func LinkStop(binds []string) {
 	linkCtrl.Lock()
 	defer linkCtrl.Unlock()
@@ -146,6 +252,9 @@ func AddLinkItemToConsole(link *Link, idx int) *LinkItem {
 		}
 		link.LastFlow = total
 		status = STATUS_LINK
+		if link.Instance.Maintenance() {
+			status = STATUS_MAINTENANCE
+		}
 	}
 
 	return &LinkItem{
@@ -155,6 +264,7 @@ func AddLinkItemToConsole(link *Link, idx int) *LinkItem {
 		Speed:   speed,
 		Traffic: total,
 		Status:  status,
+		Cert:    LinkExpiryDays(link.Bind),
 	}
 }
 
@@ -178,7 +288,13 @@ func syncToFile() {
 
 	var output []LinkConfig
 	for _, v := range linkCtrl.Cache {
-		output = append(output, v.Cfg)
+		cfg := v.Cfg
+		err := cfg.protect()
+		if err != nil {
+			logs.Error("link %s protect password failed, %s", v.Bind, err.Error())
+			return
+		}
+		output = append(output, cfg)
 	}
 
 	value, err := json.MarshalIndent(output, "", "\t")
@@ -211,6 +327,11 @@ func LinkInit() error {
 	}
 
 	for _, config := range output {
+		err = config.unprotect()
+		if err != nil {
+			logs.Error("link %s:%d unprotect password failed, %s", config.Address, config.Port, err.Error())
+		}
+
 		instance, err := NewLinkInstance(config)
 		if err != nil {
 			logs.Error(err.Error())
@@ -28,11 +28,17 @@ func main()  {
 		logs.Error(err.Error())
 		return
 	}
+	err = CertExpiryInit()
+	if err != nil {
+		logs.Error(err.Error())
+		return
+	}
 	err = LinkInit()
 	if err != nil {
 		logs.Error(err.Error())
 		return
 	}
+	CertExpiryStart()
 	err = MainWindowStart()
 	if err != nil {
 		logs.Error(err.Error())
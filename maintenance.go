@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/linimbus/tcpproxy-windows/forward"
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+const (
+	MAINTENANCE_BANNER   = "banner"
+	MAINTENANCE_FALLBACK = "fallback"
+	MAINTENANCE_QUEUE    = "queue"
+
+	MAINTENANCE_QUEUE_TIMEOUT = 60
+	MAINTENANCE_WRITE_TIMEOUT = 10 * time.Second
+)
+
+// 链路维护模式，保留原有后端配置。banner 发送文本或文件内容后关闭，
+// fallback 转发到备用后端(不使用后端TLS)，queue 挂起连接直到维护结束或超时。
+type MaintenanceConfig struct {
+	Enabled         bool   `json:"Enabled"`
+	Mode            string `json:"Mode"`
+	Banner          string `json:"Banner,omitempty"`
+	BannerFile      string `json:"BannerFile,omitempty"`
+	FallbackAddress string `json:"FallbackAddress,omitempty"`
+	FallbackPort    int    `json:"FallbackPort,omitempty"`
+	QueueTimeout    int    `json:"QueueTimeout,omitempty"`
+}
+
+func (m *MaintenanceConfig) Check() error {
+	switch m.Mode {
+	case MAINTENANCE_BANNER:
+		if m.Banner == "" && m.BannerFile == "" {
+			return fmt.Errorf("maintenance banner needs banner text or file")
+		}
+	case MAINTENANCE_FALLBACK:
+		if m.FallbackAddress == "" || m.FallbackPort == 0 {
+			return fmt.Errorf("maintenance fallback needs address and port")
+		}
+	case MAINTENANCE_QUEUE:
+	default:
+		return fmt.Errorf("unknown maintenance mode %s", m.Mode)
+	}
+	if m.BannerFile != "" {
+		_, err := os.Stat(m.BannerFile)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 开启时读取一次banner文件，修改文件后重新开启即可生效
+func (m *MaintenanceConfig) banner() []byte {
+	if m.BannerFile != "" {
+		body, err := os.ReadFile(m.BannerFile)
+		if err == nil {
+			return body
+		}
+		logs.Error(err.Error())
+	}
+	body := m.Banner
+	// 界面中输入的换行
+	body = strings.ReplaceAll(body, "\\r\\n", "\r\n")
+	body = strings.ReplaceAll(body, "\\n", "\n")
+	return []byte(body)
+}
+
+type linkMaintenance struct {
+	config  MaintenanceConfig
+	banner  []byte
+	release chan struct{}
+}
+
+func (l *LinkInstance) SetMaintenance(cfg *MaintenanceConfig) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.maintenance != nil {
+		// 放行排队中的连接
+		close(l.maintenance.release)
+		l.maintenance = nil
+	}
+	if cfg != nil && cfg.Enabled {
+		l.maintenance = &linkMaintenance{config: *cfg, banner: cfg.banner(), release: make(chan struct{})}
+		logs.Warning("link instance %s maintenance on, mode %s", l.address, cfg.Mode)
+	} else {
+		logs.Info("link instance %s maintenance off", l.address)
+	}
+}
+
+func (l *LinkInstance) Maintenance() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.maintenance != nil
+}
+
+// 维护中的连接处理，返回是否继续转发以及备用后端地址
+func (l *LinkInstance) maintenanceServe(local net.Conn) (string, bool) {
+	l.RLock()
+	m := l.maintenance
+	l.RUnlock()
+
+	if m == nil {
+		return "", true
+	}
+
+	switch m.config.Mode {
+	case MAINTENANCE_FALLBACK:
+		return fmt.Sprintf("%s:%d", m.config.FallbackAddress, m.config.FallbackPort), true
+	case MAINTENANCE_QUEUE:
+		timeout := m.config.QueueTimeout
+		if timeout <= 0 {
+			timeout = MAINTENANCE_QUEUE_TIMEOUT
+		}
+		timer := time.NewTimer(time.Duration(timeout) * time.Second)
+		select {
+		case <-m.release:
+			timer.Stop()
+			return "", !l.closed()
+		case <-timer.C:
+			logs.Info("link instance %s maintenance queue timeout %s", l.address, local.RemoteAddr().String())
+		}
+	}
+
+	if len(m.banner) > 0 {
+		if l.server != nil {
+			local = tls.Server(local, l.server)
+		}
+		local.SetWriteDeadline(time.Now().Add(MAINTENANCE_WRITE_TIMEOUT))
+		err := forward.WriteFull(local, m.banner)
+		if err != nil {
+			logs.Error(err.Error())
+		}
+	}
+	local.Close()
+	return "", false
+}
+
+// 配置链路维护模式，保存后立即生效
+func MaintenanceDialog(form walk.Form, bind string) {
+	var dlg *walk.Dialog
+	var acceptPB, cancelPB *walk.PushButton
+	var enabled *walk.CheckBox
+	var mode *walk.ComboBox
+	var banner, bannerFile, fallbackAddr *walk.LineEdit
+	var fallbackPort, queueTimeout *walk.NumberEdit
+
+	cfg := LinkFind(bind)
+	if cfg == nil {
+		return
+	}
+	m := MaintenanceConfig{Mode: MAINTENANCE_BANNER, QueueTimeout: MAINTENANCE_QUEUE_TIMEOUT}
+	if cfg.Maintenance != nil {
+		m = *cfg.Maintenance
+	}
+
+	modes := []string{MAINTENANCE_BANNER, MAINTENANCE_FALLBACK, MAINTENANCE_QUEUE}
+	modeIdx := 0
+	for i, v := range modes {
+		if v == m.Mode {
+			modeIdx = i
+		}
+	}
+
+	_, err := Dialog{
+		AssignTo:      &dlg,
+		Title:         "Link Maintenance",
+		Icon:          walk.IconInformation(),
+		DefaultButton: &acceptPB,
+		CancelButton:  &cancelPB,
+		Size:          Size{300, 200},
+		MinSize:       Size{300, 200},
+		Layout:        VBox{Margins: Margins{Top: 10, Bottom: 10, Left: 10, Right: 10}},
+		Children: []Widget{
+			Composite{
+				Layout: Grid{Columns: 2},
+				Children: []Widget{
+					Label{
+						Text: "Enabled:",
+					},
+					CheckBox{
+						AssignTo: &enabled,
+						Checked:  m.Enabled,
+					},
+					Label{
+						Text: "Mode:",
+					},
+					ComboBox{
+						AssignTo:     &mode,
+						Model:        modes,
+						CurrentIndex: modeIdx,
+					},
+					Label{
+						Text: "Banner:",
+					},
+					LineEdit{
+						AssignTo: &banner,
+						Text:     m.Banner,
+					},
+					Label{
+						Text: "Banner File:",
+					},
+					LineEdit{
+						AssignTo: &bannerFile,
+						Text:     m.BannerFile,
+					},
+					Label{
+						Text: "Fallback Address:",
+					},
+					LineEdit{
+						AssignTo: &fallbackAddr,
+						Text:     m.FallbackAddress,
+					},
+					Label{
+						Text: "Fallback Port:",
+					},
+					NumberEdit{
+						AssignTo:    &fallbackPort,
+						Value:       float64(m.FallbackPort),
+						MinValue:    0,
+						MaxValue:    65535,
+						ToolTipText: "0~65535",
+					},
+					Label{
+						Text: "Queue Timeout(s):",
+					},
+					NumberEdit{
+						AssignTo:    &queueTimeout,
+						Value:       float64(m.QueueTimeout),
+						MinValue:    1,
+						MaxValue:    3600,
+						ToolTipText: "1~3600",
+					},
+				},
+			},
+			Composite{
+				Layout: HBox{},
+				Children: []Widget{
+					PushButton{
+						AssignTo: &acceptPB,
+						Text:     "Save",
+						OnClicked: func() {
+							update := MaintenanceConfig{
+								Enabled:         enabled.Checked(),
+								Mode:            mode.Text(),
+								Banner:          banner.Text(),
+								BannerFile:      strings.TrimSpace(bannerFile.Text()),
+								FallbackAddress: strings.TrimSpace(fallbackAddr.Text()),
+								FallbackPort:    int(fallbackPort.Value()),
+								QueueTimeout:    int(queueTimeout.Value()),
+							}
+							err := LinkMaintenanceUpdate(bind, &update)
+							if err != nil {
+								ErrorBoxAction(dlg, err.Error())
+								return
+							}
+							dlg.Accept()
+						},
+					},
+					PushButton{
+						AssignTo: &cancelPB,
+						Text:     "Cancel",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Run(form)
+	if err != nil {
+		logs.Error(err.Error())
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/lxn/walk"
 	. "github.com/lxn/walk/declarative"
 )
 
@@ -12,6 +17,18 @@ func MenuBarInit() []MenuItem {
 				OpenBrowserWeb(LogDirGet())
 			},
 		},
+		Action{
+			Text: "Export CA",
+			OnTriggered: func() {
+				ExportCAAction(mainWindowCtrl.ctrl)
+			},
+		},
+		Action{
+			Text: "Cert Expiry",
+			OnTriggered: func() {
+				CertExpiryAction(mainWindowCtrl.ctrl)
+			},
+		},
 		Action{
 			Text: "Mini Windows",
 			OnTriggered: func() {
@@ -26,3 +43,38 @@ func MenuBarInit() []MenuItem {
 		},
 	}
 }
+
+// 导出本地CA证书，供客户端导入信任
+func ExportCAAction(form walk.Form) {
+	ca, err := LocalCAGet()
+	if err != nil {
+		ErrorBoxAction(form, err.Error())
+		return
+	}
+
+	dlg := &walk.FileDialog{
+		Title:    "Export CA Certificate",
+		Filter:   "PEM Certificate (*.pem)|*.pem|DER Certificate (*.cer)|*.cer",
+		FilePath: "tcpproxy-ca.pem",
+	}
+	accepted, err := dlg.ShowSave(form)
+	if err != nil {
+		logs.Error(err.Error())
+		return
+	}
+	if !accepted {
+		return
+	}
+
+	filename := dlg.FilePath
+	if dlg.FilterIndex == 2 && !strings.HasSuffix(strings.ToLower(filename), ".cer") {
+		filename += ".cer"
+	}
+
+	err = ca.Export(filename)
+	if err != nil {
+		ErrorBoxAction(form, err.Error())
+		return
+	}
+	InfoBoxAction(form, fmt.Sprintf("CA certificate exported to %s", filename))
+}
@@ -23,6 +23,16 @@ func NotifyExit()  {
 	notify = nil
 }
 
+func NotifyWarning(title string, msg string)  {
+	if notify == nil {
+		return
+	}
+	err := notify.ShowWarning(title, msg)
+	if err != nil {
+		logs.Error("notify show warning fail, %s", err.Error())
+	}
+}
+
 var lastCheck time.Time
 
 func NotifyInit(mw *walk.MainWindow)  {
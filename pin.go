@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/linimbus/tcpproxy-windows/keystore"
+)
+
+// 后端证书指纹校验。开启首次信任时，没有指纹的后端在第一次连接时记录其公钥指纹，
+// 之后证书变化会被拒绝，直到在链路详情里确认新的指纹。
+type BackendPins struct {
+	sync.Mutex
+
+	bind    string
+	tofu    bool
+	pins    *keystore.PinSet
+	pending string
+}
+
+func NewBackendPins(bind string, backend *BackendConfig) (*BackendPins, error) {
+	pins, err := keystore.ParsePins(backend.Pins)
+	if err != nil {
+		return nil, err
+	}
+	return &BackendPins{bind: bind, tofu: backend.TrustOnFirstUse, pins: pins}, nil
+}
+
+// 没有配置指纹也没有开启首次信任时不需要校验
+func (b *BackendPins) Enabled() bool {
+	return b.tofu || !b.pins.Empty()
+}
+
+func (b *BackendPins) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	certs, err := keystore.ParseChain(rawCerts)
+	if err != nil {
+		return err
+	}
+	pin := keystore.SPKIPin(certs[0])
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.pins.Empty() {
+		b.pins, _ = keystore.ParsePins([]string{pin})
+		logs.Warning("link %s trust backend on first use, pin %s", b.bind, pin)
+		// 在单独的协程里保存，避免和链路关闭时持有的锁互相等待
+		go LinkPinsUpdate(b.bind, []string{pin})
+		return nil
+	}
+
+	if b.pins.Match(certs[0], verifiedChains) {
+		return nil
+	}
+
+	b.pending = pin
+	logs.Error("link %s backend certificate changed, pin %s is not trusted", b.bind, pin)
+	return fmt.Errorf("backend certificate %s is not trusted, approve it in link detail", pin)
+}
+
+func (b *BackendPins) Pending() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.pending
+}
+
+// 确认新的指纹后替换原有指纹
+func (b *BackendPins) Approve(pin string) {
+	b.Lock()
+	defer b.Unlock()
+	b.pins, _ = keystore.ParsePins([]string{pin})
+	b.pending = ""
+}
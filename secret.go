@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"unsafe"
+
+	"github.com/linimbus/tcpproxy-windows/keystore"
+	"golang.org/x/sys/windows"
+)
+
+// 证书和私钥的密码使用DPAPI加密后保存到配置文件，只有当前Windows用户可以解密
+func passwordProtect(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	body := []byte(password)
+	in := windows.DataBlob{Size: uint32(len(body)), Data: &body[0]}
+	var out windows.DataBlob
+	err := windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return base64.StdEncoding.EncodeToString(unsafe.Slice(out.Data, out.Size)), nil
+}
+
+func passwordUnprotect(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	body, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(body) == 0 {
+		return "", err
+	}
+	in := windows.DataBlob{Size: uint32(len(body)), Data: &body[0]}
+	var out windows.DataBlob
+	err = windows.CryptUnprotectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return string(unsafe.Slice(out.Data, out.Size)), nil
+}
+
+// 保存前加密密码，旧版本明文保存的密码不再写出
+func sourceProtect(source *keystore.Source, protected *string, legacy *string) error {
+	value, err := passwordProtect(source.Password)
+	if err != nil {
+		return err
+	}
+	*protected = value
+	*legacy = ""
+	return nil
+}
+
+// 读取后解密密码，兼容旧版本明文保存的密码，下次保存时改为加密
+func sourceUnprotect(source *keystore.Source, protected *string, legacy *string) error {
+	if *legacy != "" {
+		source.Password = *legacy
+		*legacy = ""
+		return nil
+	}
+	value, err := passwordUnprotect(*protected)
+	if err != nil {
+		return err
+	}
+	source.Password = value
+	return nil
+}
+
+func (cfg *LinkConfig) protect() error {
+	err := sourceProtect(&cfg.Source, &cfg.PasswordProtected, &cfg.PasswordLegacy)
+	if err != nil {
+		return err
+	}
+	return sourceProtect(&cfg.Backend.Source, &cfg.Backend.PasswordProtected, &cfg.Backend.PasswordLegacy)
+}
+
+func (cfg *LinkConfig) unprotect() error {
+	err := sourceUnprotect(&cfg.Source, &cfg.PasswordProtected, &cfg.PasswordLegacy)
+	if err != nil {
+		return err
+	}
+	return sourceUnprotect(&cfg.Backend.Source, &cfg.Backend.PasswordProtected, &cfg.Backend.PasswordLegacy)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/astaxie/beego/logs"
 	"github.com/lxn/walk"
@@ -10,7 +11,24 @@ import (
 
 func ShowToolBar(cfg *LinkConfig) {
 	var dlg *walk.Dialog
-	var acceptPB *walk.PushButton
+	var acceptPB, approvePB *walk.PushButton
+
+	bind := fmt.Sprintf("%s:%d", cfg.Address, cfg.Port)
+	pending := LinkPendingPin(bind)
+
+	var lines []string
+	for _, v := range LinkExpiry(bind) {
+		lines = append(lines, v.String())
+	}
+	expiry := strings.Join(lines, "\n")
+
+	maintenance := "not configured"
+	if m := cfg.Maintenance; m != nil {
+		maintenance = fmt.Sprintf("%s, off", m.Mode)
+		if m.Enabled {
+			maintenance = fmt.Sprintf("%s, on", m.Mode)
+		}
+	}
 
 	cnt, err := Dialog{
 		AssignTo:      &dlg,
@@ -45,6 +63,36 @@ func ShowToolBar(cfg *LinkConfig) {
 					Label{
 						Text: cfg.Tls,
 					},
+					Label{
+						Text: "Listen Hostnames:",
+					},
+					Label{
+						Text: cfg.Hostnames,
+					},
+					Label{
+						Text: "Listen Cert:",
+					},
+					Label{
+						Text: cfg.Cert,
+					},
+					Label{
+						Text: "Listen Key:",
+					},
+					Label{
+						Text: cfg.Key,
+					},
+					Label{
+						Text: "Listen Pkcs12:",
+					},
+					Label{
+						Text: cfg.Pkcs12,
+					},
+					Label{
+						Text: "Listen Client CA:",
+					},
+					Label{
+						Text: cfg.CAFile,
+					},
 					Label{
 						Text: "Backend Address:",
 					},
@@ -63,11 +111,97 @@ func ShowToolBar(cfg *LinkConfig) {
 					Label{
 						Text: cfg.Backend.Tls,
 					},
+					Label{
+						Text: "Backend Source:",
+					},
+					Label{
+						Text: cfg.Backend.SourceAddress,
+					},
+					Label{
+						Text: "Backend Interface:",
+					},
+					Label{
+						Text: cfg.Backend.BindInterface,
+					},
+					Label{
+						Text: "Backend CA:",
+					},
+					Label{
+						Text: cfg.Backend.CAFile,
+					},
+					Label{
+						Text: "Backend Cert:",
+					},
+					Label{
+						Text: cfg.Backend.Cert,
+					},
+					Label{
+						Text: "Backend Key:",
+					},
+					Label{
+						Text: cfg.Backend.Key,
+					},
+					Label{
+						Text: "Backend Pkcs12:",
+					},
+					Label{
+						Text: cfg.Backend.Pkcs12,
+					},
+					Label{
+						Text: "Backend Pins:",
+					},
+					Label{
+						Text: strings.Join(cfg.Backend.Pins, "\n"),
+					},
+					Label{
+						Text: "Backend TOFU:",
+					},
+					Label{
+						Text: fmt.Sprintf("%v", cfg.Backend.TrustOnFirstUse),
+					},
+					Label{
+						Text: "Cert Expiry:",
+					},
+					Label{
+						Text: expiry,
+					},
+					Label{
+						Text: "Maintenance:",
+					},
+					Label{
+						Text: maintenance,
+					},
+					Label{
+						Text: "Pending Pin:",
+					},
+					Label{
+						Text: pending,
+					},
 				},
 			},
 			Composite{
-				Layout: VBox{},
+				Layout: HBox{},
 				Children: []Widget{
+					PushButton{
+						AssignTo: &approvePB,
+						Text:     "Approve Pin",
+						Enabled:  pending != "",
+						OnClicked: func() {
+							err := LinkPinApprove(bind)
+							if err != nil {
+								ErrorBoxAction(dlg, err.Error())
+								return
+							}
+							approvePB.SetEnabled(false)
+							InfoBoxAction(dlg, fmt.Sprintf("Backend pin %s approved", pending))
+						},
+					},
+					PushButton{
+						Text: "Maintenance",
+						OnClicked: func() {
+							MaintenanceDialog(dlg, bind)
+						},
+					},
 					PushButton{
 						AssignTo: &acceptPB,
 						Text:     "OK",
@@ -0,0 +1,22 @@
+//go:build linux
+
+package sockopt
+
+import (
+	"syscall"
+)
+
+// BindDevice returns a Control hook that pins the socket to an interface
+// with SO_BINDTODEVICE.
+func BindDevice(iface string) (Control, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var operr error
+		err := c.Control(func(fd uintptr) {
+			operr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return operr
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sockopt
+
+import (
+	"fmt"
+)
+
+// BindDevice is only available on Linux.
+func BindDevice(iface string) (Control, error) {
+	return nil, fmt.Errorf("bind interface %s: %w", iface, ErrUnsupported)
+}
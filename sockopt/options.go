@@ -0,0 +1,80 @@
+package sockopt
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Options is the socket-options block of listeners and clusters. Zero
+// values leave the OS default in place.
+type Options struct {
+	KeepAliveIdle     int    `yaml:"keepalive_idle"`
+	KeepAliveInterval int    `yaml:"keepalive_interval"`
+	KeepAliveCount    int    `yaml:"keepalive_count"`
+	NoDelay           *bool  `yaml:"no_delay"`
+	RecvBuffer        int    `yaml:"recv_buffer"`
+	SendBuffer        int    `yaml:"send_buffer"`
+	UserTimeout       int    `yaml:"user_timeout"`
+	Tos               int    `yaml:"tos"`
+	Dscp              int    `yaml:"dscp"`
+	Linger            *int   `yaml:"linger"`
+	Congestion        string `yaml:"congestion"`
+}
+
+// KeepAlive reports whether keepalive is configured here, in which case the
+// Go runtime defaults must be turned off with a negative KeepAlive.
+func (o *Options) KeepAlive() bool {
+	return o != nil && (o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0)
+}
+
+func (o *Options) tos() int {
+	if o.Dscp > 0 {
+		return o.Dscp << 2
+	}
+	return o.Tos
+}
+
+// Control validates the options against the current OS and returns the
+// hook for net.Dialer or net.ListenConfig.
+func (o *Options) Control() (Control, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	if o.Tos > 0 && o.Dscp > 0 {
+		return nil, fmt.Errorf("socket options tos and dscp are exclusive")
+	}
+	if o.Dscp < 0 || o.Dscp > 63 || o.Tos < 0 || o.Tos > 255 {
+		return nil, fmt.Errorf("socket options tos or dscp out of range")
+	}
+
+	list := o.unsupported()
+	if len(list) > 0 {
+		return nil, fmt.Errorf("socket options %s: %w", strings.Join(list, ", "), ErrUnsupported)
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var operr error
+		err := c.Control(func(fd uintptr) {
+			operr = o.apply(fd, network)
+		})
+		if err != nil {
+			return err
+		}
+		return operr
+	}, nil
+}
+
+// Apply sets what the Go runtime overrides after connect and accept.
+func (o *Options) Apply(conn net.Conn) error {
+	if o == nil || o.NoDelay == nil {
+		return nil
+	}
+	tcpconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpconn.SetNoDelay(*o.NoDelay)
+}
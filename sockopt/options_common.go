@@ -0,0 +1,61 @@
+//go:build linux || windows
+
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// applyCommon sets the options Linux and Windows share.
+func (o *Options) applyCommon(fd uintptr) error {
+	var err error
+	if o.RecvBuffer > 0 {
+		err = setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.RecvBuffer)
+		if err != nil {
+			return fmt.Errorf("recv_buffer: %w", err)
+		}
+	}
+	if o.SendBuffer > 0 {
+		err = setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer)
+		if err != nil {
+			return fmt.Errorf("send_buffer: %w", err)
+		}
+	}
+	if o.Linger != nil {
+		linger := &syscall.Linger{}
+		if *o.Linger >= 0 {
+			linger.Onoff = 1
+			linger.Linger = int32(*o.Linger)
+		}
+		err = setsockoptLinger(fd, linger)
+		if err != nil {
+			return fmt.Errorf("linger: %w", err)
+		}
+	}
+	if o.KeepAlive() {
+		err = setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+		if err != nil {
+			return fmt.Errorf("keepalive: %w", err)
+		}
+		if o.KeepAliveIdle > 0 {
+			err = setsockoptInt(fd, syscall.IPPROTO_TCP, tcpKeepIdle, o.KeepAliveIdle)
+			if err != nil {
+				return fmt.Errorf("keepalive_idle: %w", err)
+			}
+		}
+		if o.KeepAliveInterval > 0 {
+			err = setsockoptInt(fd, syscall.IPPROTO_TCP, tcpKeepInterval, o.KeepAliveInterval)
+			if err != nil {
+				return fmt.Errorf("keepalive_interval: %w", err)
+			}
+		}
+		if o.KeepAliveCount > 0 {
+			err = setsockoptInt(fd, syscall.IPPROTO_TCP, tcpKeepCount, o.KeepAliveCount)
+			if err != nil {
+				return fmt.Errorf("keepalive_count: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package sockopt
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+const (
+	tcpKeepIdle      = syscall.TCP_KEEPIDLE
+	tcpKeepInterval  = syscall.TCP_KEEPINTVL
+	tcpKeepCount     = syscall.TCP_KEEPCNT
+	tcpUserTimeout   = 0x12
+	ipv6TrafficClass = 0x43
+)
+
+func setsockoptInt(fd uintptr, level int, opt int, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
+
+func setsockoptLinger(fd uintptr, linger *syscall.Linger) error {
+	return syscall.SetsockoptLinger(int(fd), syscall.SOL_SOCKET, syscall.SO_LINGER, linger)
+}
+
+func (o *Options) unsupported() []string {
+	return nil
+}
+
+func (o *Options) apply(fd uintptr, network string) error {
+	err := o.applyCommon(fd)
+	if err != nil {
+		return err
+	}
+
+	if o.UserTimeout > 0 {
+		err = setsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, o.UserTimeout)
+		if err != nil {
+			return fmt.Errorf("user_timeout: %w", err)
+		}
+	}
+
+	if tos := o.tos(); tos > 0 {
+		if strings.HasSuffix(network, "6") {
+			err = setsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6TrafficClass, tos)
+		} else {
+			err = setsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+		if err != nil {
+			return fmt.Errorf("tos: %w", err)
+		}
+	}
+
+	if o.Congestion != "" {
+		err = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, o.Congestion)
+		if err != nil {
+			return fmt.Errorf("congestion %s: %w", o.Congestion, err)
+		}
+	}
+	return nil
+}
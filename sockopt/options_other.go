@@ -0,0 +1,34 @@
+//go:build !linux && !windows
+
+package sockopt
+
+// Only no_delay is applied here, through net.TCPConn.
+func (o *Options) unsupported() []string {
+	var list []string
+	if o.KeepAlive() {
+		list = append(list, "keepalive")
+	}
+	if o.RecvBuffer > 0 {
+		list = append(list, "recv_buffer")
+	}
+	if o.SendBuffer > 0 {
+		list = append(list, "send_buffer")
+	}
+	if o.Linger != nil {
+		list = append(list, "linger")
+	}
+	if o.UserTimeout > 0 {
+		list = append(list, "user_timeout")
+	}
+	if o.tos() > 0 {
+		list = append(list, "tos/dscp")
+	}
+	if o.Congestion != "" {
+		list = append(list, "congestion")
+	}
+	return list
+}
+
+func (o *Options) apply(fd uintptr, network string) error {
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+package sockopt
+
+import (
+	"syscall"
+)
+
+// Windows 10 1709 and later
+const (
+	tcpKeepIdle     = 3
+	tcpKeepInterval = 17
+	tcpKeepCount    = 16
+)
+
+func setsockoptInt(fd uintptr, level int, opt int, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, opt, value)
+}
+
+func setsockoptLinger(fd uintptr, linger *syscall.Linger) error {
+	return syscall.SetsockoptLinger(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_LINGER, linger)
+}
+
+func (o *Options) unsupported() []string {
+	var list []string
+	if o.UserTimeout > 0 {
+		list = append(list, "user_timeout")
+	}
+	if o.tos() > 0 {
+		list = append(list, "tos/dscp")
+	}
+	if o.Congestion != "" {
+		list = append(list, "congestion")
+	}
+	return list
+}
+
+func (o *Options) apply(fd uintptr, network string) error {
+	return o.applyCommon(fd)
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package sockopt
+
+import (
+	"syscall"
+)
+
+const soReusePort = 0xf
+
+// ReusePort returns a Control hook that sets SO_REUSEPORT so several
+// sockets can listen on the same address and the kernel spreads new
+// connections across them.
+func ReusePort() (Control, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var operr error
+		err := c.Control(func(fd uintptr) {
+			operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return operr
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sockopt
+
+import (
+	"fmt"
+)
+
+// ReusePort is only available on Linux.
+func ReusePort() (Control, error) {
+	return nil, fmt.Errorf("reuse port: %w", ErrUnsupported)
+}
@@ -0,0 +1,87 @@
+// Package sockopt holds the socket level helpers shared by the engine and
+// the desktop links: local source address pools and Control hooks for
+// net.Dialer and net.ListenConfig.
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// ErrUnsupported is returned for options the current OS can not apply.
+var ErrUnsupported = errors.New("not supported on this os")
+
+// Control is the signature of net.Dialer.Control and net.ListenConfig.Control.
+type Control func(network, address string, c syscall.RawConn) error
+
+// SourcePool rotates the local address of outgoing connections so a busy
+// backend does not run out of ephemeral ports on a single source IP.
+type SourcePool struct {
+	ips  []net.IP
+	next uint32
+}
+
+func NewSourcePool(list []string) (*SourcePool, error) {
+	pool := new(SourcePool)
+	for _, v := range list {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("source address %s is not an ip", v)
+		}
+		pool.ips = append(pool.ips, ip)
+	}
+	if len(pool.ips) == 0 {
+		return nil, nil
+	}
+	return pool, nil
+}
+
+// Next returns the next source address of the same family as the
+// destination, or nil to let the OS choose.
+func (p *SourcePool) Next(address string) *net.TCPAddr {
+	if p == nil {
+		return nil
+	}
+
+	v4 := true
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			v4 = ip.To4() != nil
+		}
+	}
+
+	start := atomic.AddUint32(&p.next, 1)
+	for i := 0; i < len(p.ips); i++ {
+		ip := p.ips[(int(start)+i)%len(p.ips)]
+		if (ip.To4() != nil) == v4 {
+			return &net.TCPAddr{IP: ip}
+		}
+	}
+	return nil
+}
+
+// Chain runs several Control hooks in order and stops at the first error.
+func Chain(controls ...Control) Control {
+	var list []Control
+	for _, v := range controls {
+		if v != nil {
+			list = append(list, v)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, v := range list {
+			err := v(network, address, c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -1,66 +1,83 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
-	"math/big"
-	"net"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/linimbus/tcpproxy-windows/keystore"
 )
 
-func tlsCert(addr string) (tls.Certificate, error) {
-	max := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, _ := rand.Int(rand.Reader, max)
-	subject := pkix.Name{
-		Organization:       []string{"TcpProxy App co."},
-		OrganizationalUnit: []string{"TcpProxy App"},
-		CommonName:         "TcpProxy App",
-	}
+// 由本地CA签发的链路证书，每次握手时获取，临近过期时自动续期
+type localLeaf struct {
+	sync.Mutex
 
-	if addr == "0.0.0.0" || addr == "::" {
-		addr = "127.0.0.1"
-	}
+	name     string
+	sans     []string
+	client   bool
+	notAfter time.Time
+}
 
-	ipAddress := make([]net.IP, 0)
-	ipAddress = append(ipAddress, net.ParseIP(addr))
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject:      subject,
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IPAddresses:  ipAddress,
+func newLocalLeaf(name string, sans []string, client bool) (*localLeaf, error) {
+	leaf := &localLeaf{name: name, sans: sans, client: client}
+	// 先签发一次，出错时链路不启动
+	_, err := leaf.get()
+	if err != nil {
+		return nil, err
 	}
-	pk, _ := rsa.GenerateKey(rand.Reader, 2048)
-
-	derBytes, _ := x509.CreateCertificate(rand.Reader, &template, &template, &pk.PublicKey, pk)
+	return leaf, nil
+}
 
-	certOut := bytes.NewBuffer(make([]byte, 0))
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+func (l *localLeaf) get() (*tls.Certificate, error) {
+	ca, err := LocalCAGet()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.Issue(l.sans, l.client)
+	if err != nil {
+		logs.Error("link %s issue certificate failed, %s", l.name, err.Error())
+		return nil, err
+	}
 
-	keyOut := bytes.NewBuffer(make([]byte, 0))
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)})
+	// 续期后更新到期监控
+	l.Lock()
+	if !cert.Leaf.NotAfter.Equal(l.notAfter) {
+		l.notAfter = cert.Leaf.NotAfter
+		certExpiry.TrackPair(l.name, *cert)
+	}
+	l.Unlock()
+	return cert, nil
+}
 
-	return tls.X509KeyPair(certOut.Bytes(), keyOut.Bytes())
+func (l *localLeaf) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.get()
 }
 
-func TlsConfigClient(server string, client string, version string) (*tls.Config, error) {
-	var certs tls.Certificate
-	var err error
+func (l *localLeaf) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return l.get()
+}
 
-	certs, err = tlsCert(client)
+// 加载用户提供的证书和私钥，并检查有效期
+func tlsLoadKeyPair(source *keystore.Source) (tls.Certificate, error) {
+	cert, err := source.Load()
 	if err != nil {
-		return nil, err
+		return tls.Certificate{}, err
 	}
 
+	now := time.Now()
+	if now.Before(cert.Leaf.NotBefore) {
+		return tls.Certificate{}, fmt.Errorf("certificate %s is not valid before %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotBefore.Format(time.DateTime))
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return tls.Certificate{}, fmt.Errorf("certificate %s expired at %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.DateTime))
+	}
+	return cert, nil
+}
+
+func tlsVersion(version string) uint16 {
 	tls_version := tls.VersionTLS13
 
 	if strings.Compare(version, "TLS1.2") == 0 {
@@ -71,38 +88,78 @@ func TlsConfigClient(server string, client string, version string) (*tls.Config,
 		tls_version = tls.VersionTLS13
 	}
 
-	return &tls.Config{
-		MinVersion:         uint16(tls_version),
+	return uint16(tls_version)
+}
+
+// 后端配置了CA时校验后端证书，配置了客户端证书时使用它，否则由本地CA签发
+func TlsConfigClient(bind string, backend *BackendConfig, client string, version string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tlsVersion(version),
 		MaxVersion:         tls.VersionTLS13,
-		ServerName:         server,
+		ServerName:         backend.Address,
 		InsecureSkipVerify: true,
-		Certificates:       []tls.Certificate{certs},
-	}, nil
-}
+	}
+
+	name := linkExpiryName(bind, "backend")
+	if !backend.Source.Empty() {
+		certs, err := tlsLoadKeyPair(&backend.Source)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certs}
+		certExpiry.TrackPair(name, certs)
+	} else {
+		leaf, err := newLocalLeaf(name, tlsHostnames(client, ""), true)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = leaf.GetClientCertificate
+	}
 
-func TlsConfigServer(server string, version string) (*tls.Config, error) {
-	var certs tls.Certificate
 	var err error
 
-	certs, err = tlsCert(server)
-	if err != nil {
-		return nil, err
+	if backend.CAFile != "" {
+		config.RootCAs, err = keystore.LoadCA(backend.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.InsecureSkipVerify = false
 	}
+	return config, nil
+}
 
-	tls_version := tls.VersionTLS13
-
-	if strings.Compare(version, "TLS1.2") == 0 {
-		tls_version = tls.VersionTLS12
+// 监听配置了证书时使用它，否则由本地CA签发；配置了CA时要求并校验客户端证书
+func TlsConfigServer(bind string, link *LinkConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tlsVersion(link.Tls),
+		MaxVersion: tls.VersionTLS13,
+		ClientAuth: tls.RequestClientCert,
 	}
 
-	if strings.Compare(version, "TLS1.3") == 0 {
-		tls_version = tls.VersionTLS13
+	name := linkExpiryName(bind, "listen")
+	if !link.Source.Empty() {
+		certs, err := tlsLoadKeyPair(&link.Source)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certs}
+		certExpiry.TrackPair(name, certs)
+	} else {
+		leaf, err := newLocalLeaf(name, tlsHostnames(link.Address, link.Hostnames), false)
+		if err != nil {
+			return nil, err
+		}
+		config.GetCertificate = leaf.GetCertificate
 	}
 
-	return &tls.Config{
-		MinVersion:   uint16(tls_version),
-		MaxVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{certs},
-		ClientAuth:   tls.RequestClientCert,
-	}, nil
+	var err error
+
+	if link.CAFile != "" {
+		config.ClientCAs, err = keystore.LoadCA(link.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
 }
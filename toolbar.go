@@ -37,6 +37,19 @@ func LinkStopToolBar()  {
 	consoleLinkTable.LinkTableSelectClean()
 }
 
+func LinkMaintenanceToolBar()  {
+	list := consoleLinkTable.LinkTableSelectList()
+	if len(list) == 0 {
+		ErrorBoxAction(MainWindowsCtrl(), "No object selected")
+		return
+	}
+	err := LinkMaintenanceToggle(list)
+	if err != nil {
+		ErrorBoxAction(MainWindowsCtrl(), err.Error())
+	}
+	consoleLinkTable.LinkTableSelectClean()
+}
+
 func ToolBarInit() ToolBar {
 	return ToolBar{
 		AssignTo: &toolBars,
@@ -71,6 +84,13 @@ func ToolBarInit() ToolBar {
 					go LinkStopToolBar()
 				},
 			},
+			Action{
+				Text: "Maintenance",
+				Image: ICON_TOOL_SETTING,
+				OnTriggered: func() {
+					go LinkMaintenanceToolBar()
+				},
+			},
 			//Action{
 			//	Text: "Setting",
 			//	Image: ICON_TOOL_SETTING,
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -110,19 +109,3 @@ func LogInit() error {
 	logs.SetLogFuncCallDepth(3)
 	return nil
 }
-
-func WriteFull(w io.Writer, body []byte) error {
-	begin := 0
-	for {
-		cnt, err := w.Write(body[begin:])
-		if cnt > 0 {
-			begin += cnt
-		}
-		if begin >= len(body) {
-			return err
-		}
-		if err != nil {
-			return err
-		}
-	}
-}